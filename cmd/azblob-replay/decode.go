@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ugorji/go/codec"
+)
+
+// msgpackHandle encodes the Raw events of msgpack blobs as they are.
+var msgpackHandle = &codec.MsgpackHandle{
+	BasicHandle: codec.BasicHandle{EncodeOptions: codec.EncodeOptions{Raw: true}},
+}
+
+// Format is the encoding of the records of a blob.
+type Format struct {
+	Compression string // "", "gzip" or "zstd"
+	Msgpack     bool   // msgpack events, or JSON lines otherwise
+}
+
+// DetectFormat tells the format of a blob by its name and Content-Encoding,
+// as written by the Store_As formats of out_azblob.
+func DetectFormat(name, contentEncoding string) (Format, error) {
+	var f Format
+	ext := path.Ext(name)
+	switch {
+	case ext == ".gz" || contentEncoding == "gzip":
+		f.Compression = "gzip"
+	case ext == ".zst" || contentEncoding == "zstd":
+		f.Compression = "zstd"
+	}
+	if ext == ".gz" || ext == ".zst" {
+		ext = path.Ext(strings.TrimSuffix(name, ext))
+	}
+
+	switch ext {
+	case ".msgpack":
+		f.Msgpack = true
+	case ".parquet", ".avro", ".csv", ".tsv":
+		return f, fmt.Errorf("unsupported format %s", ext)
+	}
+
+	return f, nil
+}
+
+// BlobDecoder reads the records of a blob as msgpack encoded events of
+// Fluent Bit.
+type BlobDecoder struct {
+	format  Format
+	lines   *bufio.Reader
+	events  *codec.Decoder
+	timeKey string
+	modTime time.Time
+	close   func()
+
+	// Skipped counts the lines which are not JSON records.
+	Skipped int
+}
+
+// NewBlobDecoder reads a blob of the format. JSON records without the
+// timeKey are sent with modTime, the last modified time of the blob.
+func NewBlobDecoder(r io.Reader, format Format, timeKey string,
+	modTime time.Time) (*BlobDecoder, error) {
+	var close func()
+	switch format.Compression {
+	case "gzip":
+		// Batches appended to a blob are gzip members of their own.
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+		close = zr.Close
+	}
+
+	d := &BlobDecoder{format: format, timeKey: timeKey, modTime: modTime,
+		close: close}
+	if format.Msgpack {
+		d.events = codec.NewDecoder(r, msgpackHandle)
+	} else {
+		d.lines = bufio.NewReader(r)
+	}
+
+	return d, nil
+}
+
+// Next returns the next event, or nil at the end of the blob. Lines which
+// are not JSON records are skipped and counted.
+func (d *BlobDecoder) Next() ([]byte, error) {
+	if d.format.Msgpack {
+		// Events are sent verbatim.
+		var raw codec.Raw
+		if err := d.events.Decode(&raw); err != nil {
+			if err == io.EOF {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return raw, nil
+	}
+
+	for {
+		line, err := d.lines.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			event, eerr := d.event(line)
+			if eerr == nil {
+				return event, nil
+			}
+			d.Skipped++
+		}
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close releases the decompressor of the blob.
+func (d *BlobDecoder) Close() {
+	if d.close != nil {
+		d.close()
+	}
+}
+
+// event encodes a JSON record as an event of Fluent Bit.
+func (d *BlobDecoder) event(line []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(line))
+	dec.UseNumber()
+
+	var record map[string]interface{}
+	if err := dec.Decode(&record); err != nil {
+		return nil, fmt.Errorf("invalid record %q: %v", line, err)
+	}
+
+	t := d.modTime
+	if v, ok := record[d.timeKey]; ok && d.timeKey != "" {
+		if rt, ok := parseTime(v); ok {
+			t = rt
+		}
+	}
+
+	// The timestamp is the EventTime extension type of Fluent Bit.
+	ts := make([]byte, 8)
+	binary.BigEndian.PutUint32(ts, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(ts[4:], uint32(t.Nanosecond()))
+
+	var b []byte
+	err := codec.NewEncoderBytes(&b, msgpackHandle).Encode([]interface{}{
+		codec.RawExt{Tag: 0, Data: ts}, msgpackValue(record)})
+
+	return b, err
+}
+
+// parseTime reads a time in RFC 3339 or in seconds since the epoch.
+func parseTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case string:
+		rt, err := time.Parse(time.RFC3339Nano, t)
+		return rt, err == nil
+	case json.Number:
+		f, err := strconv.ParseFloat(t.String(), 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		sec := int64(f)
+		return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+	}
+
+	return time.Time{}, false
+}
+
+// msgpackValue converts the numbers of a JSON value to integers or floats,
+// which would be encoded as strings otherwise.
+func msgpackValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, v := range t {
+			t[k] = msgpackValue(v)
+		}
+	case []interface{}:
+		for i, v := range t {
+			t[i] = msgpackValue(v)
+		}
+	}
+
+	return v
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// ForwardClient sends events over the Forward protocol of Fluentd, which
+// the forward input of Fluent Bit speaks as well.
+type ForwardClient struct {
+	conn    net.Conn
+	dec     *codec.Decoder
+	ack     bool
+	timeout time.Duration
+}
+
+func DialForward(addr string, ack bool, timeout time.Duration) (*ForwardClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("connect forward error: %v", err)
+	}
+
+	return &ForwardClient{
+		conn:    conn,
+		dec:     codec.NewDecoder(conn, msgpackHandle),
+		ack:     ack,
+		timeout: timeout,
+	}, nil
+}
+
+// Send sends msgpack encoded events as a message in Forward mode, and waits
+// for its ack if enabled.
+func (c *ForwardClient) Send(tag string, events [][]byte) error {
+	entries := make([]codec.Raw, len(events))
+	for i, e := range events {
+		entries[i] = e
+	}
+
+	options := map[string]interface{}{"size": len(events)}
+	var chunk string
+	if c.ack {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		chunk = base64.StdEncoding.EncodeToString(id)
+		options["chunk"] = chunk
+	}
+
+	var b []byte
+	err := codec.NewEncoderBytes(&b, msgpackHandle).Encode(
+		[]interface{}{tag, entries, options})
+	if err != nil {
+		return err
+	}
+
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return fmt.Errorf("send forward error: %v", err)
+	}
+	if _, err := c.conn.Write(b); err != nil {
+		return fmt.Errorf("send forward error: %v", err)
+	}
+	if !c.ack {
+		return nil
+	}
+
+	var resp map[string]interface{}
+	if err := c.dec.Decode(&resp); err != nil {
+		return fmt.Errorf("read ack error: %v", err)
+	}
+
+	var ack string
+	switch v := resp["ack"].(type) {
+	case string:
+		ack = v
+	case []byte:
+		ack = string(v)
+	}
+	if ack != chunk {
+		return fmt.Errorf("unexpected ack %q, expected %q", ack, chunk)
+	}
+
+	return nil
+}
+
+func (c *ForwardClient) Close() error {
+	return c.conn.Close()
+}
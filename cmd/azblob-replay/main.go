@@ -0,0 +1,284 @@
+// Command azblob-replay sends the records archived by out_azblob to the
+// forward input of Fluent Bit or Fluentd, e.g. for backfills.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	DefaultForward   = "127.0.0.1:24224"
+	DefaultTag       = "azblob.replay"
+	DefaultChunkSize = 1000
+	DefaultTimeout   = 30 * time.Second
+)
+
+type Options struct {
+	Account   string
+	AccessKey string
+	SAS       string
+	Endpoint  string
+	Container string
+	Prefix    string
+	From      time.Time
+	To        time.Time
+	Forward   string
+	Tag       string
+	TimeKey   string
+	ChunkSize int
+	Ack       bool
+	Timeout   time.Duration
+	DryRun    bool
+}
+
+func parseOptions(args []string) (*Options, error) {
+	o := &Options{}
+	var from, to string
+
+	fs := flag.NewFlagSet("azblob-replay", flag.ContinueOnError)
+	fs.StringVar(&o.Account, "account", os.Getenv("AZURE_STORAGE_ACCOUNT"),
+		"storage account name")
+	fs.StringVar(&o.AccessKey, "key", os.Getenv("AZURE_STORAGE_ACCESS_KEY"),
+		"storage account access key")
+	fs.StringVar(&o.SAS, "sas", os.Getenv("AZURE_STORAGE_SAS"),
+		"shared access signature, instead of -key")
+	fs.StringVar(&o.Endpoint, "endpoint", "",
+		"blob service URL, https://<account>.blob.core.windows.net by default")
+	fs.StringVar(&o.Container, "container", "", "container of the blobs")
+	fs.StringVar(&o.Prefix, "prefix", "", "prefix of the object keys")
+	fs.StringVar(&from, "from", "",
+		"replay blobs last modified at or after this time (RFC 3339), "+
+			"whatever the time of their records")
+	fs.StringVar(&to, "to", "",
+		"replay blobs last modified before this time (RFC 3339), "+
+			"so a blob appended to after it is left out")
+	fs.StringVar(&o.Forward, "forward", DefaultForward,
+		"address of the forward input")
+	fs.StringVar(&o.Tag, "tag", DefaultTag, "tag of the replayed records")
+	fs.StringVar(&o.TimeKey, "time-key", "",
+		"record key holding the time of JSON records, "+
+			"the last modified time of the blob by default")
+	fs.IntVar(&o.ChunkSize, "chunk-size", DefaultChunkSize,
+		"maximum number of records of a forward message")
+	fs.BoolVar(&o.Ack, "ack", true, "wait for the ack of every message")
+	fs.DurationVar(&o.Timeout, "timeout", DefaultTimeout,
+		"timeout of the forward connection and acks")
+	fs.BoolVar(&o.DryRun, "dry-run", false,
+		"list the blobs and count their records without sending them")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if o.Container == "" {
+		return nil, fmt.Errorf("missing -container")
+	}
+	if o.Account == "" && o.Endpoint == "" {
+		return nil, fmt.Errorf("missing -account or -endpoint")
+	}
+	if o.ChunkSize < 1 {
+		return nil, fmt.Errorf("invalid -chunk-size: %d", o.ChunkSize)
+	}
+
+	var err error
+	if from != "" {
+		if o.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return nil, fmt.Errorf("invalid -from: %v", err)
+		}
+	}
+	if to != "" {
+		if o.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return nil, fmt.Errorf("invalid -to: %v", err)
+		}
+	}
+
+	return o, nil
+}
+
+func (o *Options) containerURL() (azblob.ContainerURL, error) {
+	endpoint := o.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.blob.core.windows.net", o.Account)
+	}
+
+	URL, err := url.Parse(endpoint)
+	if err != nil {
+		return azblob.ContainerURL{}, fmt.Errorf("invalid -endpoint: %v", err)
+	}
+	URL.Path = strings.TrimSuffix(URL.Path, "/") + "/" + o.Container
+
+	var credential azblob.Credential
+	switch {
+	case o.SAS != "":
+		URL.RawQuery = strings.TrimPrefix(o.SAS, "?")
+		credential = azblob.NewAnonymousCredential()
+	case o.AccessKey != "":
+		credential, err = azblob.NewSharedKeyCredential(o.Account, o.AccessKey)
+		if err != nil {
+			return azblob.ContainerURL{}, fmt.Errorf("invalid -key: %v", err)
+		}
+	default:
+		credential = azblob.NewAnonymousCredential()
+	}
+
+	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	return azblob.NewContainerURL(*URL, p), nil
+}
+
+// inRange reports whether a blob modified at t is replayed.
+func (o *Options) inRange(t time.Time) bool {
+	if !o.From.IsZero() && t.Before(o.From) {
+		return false
+	}
+	if !o.To.IsZero() && !t.Before(o.To) {
+		return false
+	}
+
+	return true
+}
+
+func run(o *Options) error {
+	containerURL, err := o.containerURL()
+	if err != nil {
+		return err
+	}
+
+	var client *ForwardClient
+	if !o.DryRun {
+		client, err = DialForward(o.Forward, o.Ack, o.Timeout)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+	}
+
+	ctx := context.Background()
+	var blobs, events int
+	var incomplete []string
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := containerURL.ListBlobsFlatSegment(ctx, marker,
+			azblob.ListBlobsSegmentOptions{Prefix: o.Prefix})
+		if err != nil {
+			return fmt.Errorf("list blobs error: %v", err)
+		}
+		marker = resp.NextMarker
+
+		for _, item := range resp.Segment.BlobItems {
+			if !o.inRange(item.Properties.LastModified) {
+				continue
+			}
+
+			n, complete, err := replayBlob(ctx, o, containerURL, item, client)
+			if err != nil {
+				return fmt.Errorf("replay blob %s error: %v", item.Name, err)
+			}
+			if !complete {
+				incomplete = append(incomplete, item.Name)
+			}
+			logrus.Infof("replayed blob=%s records=%d", item.Name, n)
+			blobs++
+			events += n
+		}
+	}
+
+	logrus.Infof("replayed blobs=%d records=%d", blobs, events)
+	if len(incomplete) > 0 {
+		return fmt.Errorf("blobs not fully replayed: %s",
+			strings.Join(incomplete, ", "))
+	}
+	return nil
+}
+
+// replayBlob sends the records of a blob, and reports whether the blob was
+// replayed to its end. Blobs which are not archives are skipped as complete.
+func replayBlob(ctx context.Context, o *Options, containerURL azblob.ContainerURL,
+	item azblob.BlobItem, client *ForwardClient) (int, bool, error) {
+	var encoding string
+	if item.Properties.ContentEncoding != nil {
+		encoding = *item.Properties.ContentEncoding
+	}
+
+	format, err := DetectFormat(item.Name, encoding)
+	if err != nil {
+		logrus.Warnf("skip blob=%s: %v", item.Name, err)
+		return 0, true, nil
+	}
+
+	resp, err := containerURL.NewBlobURL(item.Name).Download(
+		ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return 0, false, err
+	}
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+
+	dec, err := NewBlobDecoder(body, format, o.TimeKey,
+		item.Properties.LastModified)
+	if err == io.EOF {
+		// An append blob is empty until its first batch.
+		return 0, true, nil
+	}
+	if err != nil {
+		logrus.Warnf("skip blob=%s: %v", item.Name, err)
+		return 0, false, nil
+	}
+	defer dec.Close()
+
+	count := 0
+	complete := true
+	chunk := make([][]byte, 0, o.ChunkSize)
+	for {
+		event, err := dec.Next()
+		if err != nil {
+			// A blob which is not in the format of its name is not
+			// replayed further, without stopping the other blobs.
+			logrus.Warnf("skip rest of blob=%s: %v", item.Name, err)
+			event = nil
+			complete = false
+		}
+		if event != nil {
+			chunk = append(chunk, event)
+		}
+
+		if len(chunk) > 0 && (event == nil || len(chunk) == o.ChunkSize) {
+			if client != nil {
+				if err := client.Send(o.Tag, chunk); err != nil {
+					return count, false, err
+				}
+			}
+			count += len(chunk)
+			chunk = chunk[:0]
+		}
+		if event == nil {
+			if dec.Skipped > 0 {
+				logrus.Warnf("skipped invalid records=%d of blob=%s",
+					dec.Skipped, item.Name)
+			}
+			return count, complete, nil
+		}
+	}
+}
+
+func main() {
+	o, err := parseOptions(os.Args[1:])
+	if err != nil {
+		if err != flag.ErrHelp {
+			logrus.Error(err)
+			os.Exit(2)
+		}
+		return
+	}
+
+	if err := run(o); err != nil {
+		logrus.Fatal(err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/ugorji/go/codec"
+)
+
+func TestParseOptions(t *testing.T) {
+	o, err := parseOptions([]string{"-account", "testAccount",
+		"-container", "testContainer", "-from", "2020-10-11T00:00:00Z"})
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultForward, o.Forward)
+	assert.Equal(t, DefaultChunkSize, o.ChunkSize)
+	assert.True(t, o.Ack)
+
+	from := time.Date(2020, 10, 11, 0, 0, 0, 0, time.UTC)
+	assert.False(t, o.inRange(from.Add(-time.Second)))
+	assert.True(t, o.inRange(from))
+
+	URL, err := o.containerURL()
+	assert.Nil(t, err)
+	assert.Equal(t, "https://testAccount.blob.core.windows.net/testContainer",
+		URL.String())
+
+	for _, args := range [][]string{
+		{"-account", "testAccount"},
+		{"-container", "testContainer"},
+		{"-account", "testAccount", "-container", "c", "-to", "yesterday"},
+		{"-account", "testAccount", "-container", "c", "-chunk-size", "0"},
+	} {
+		_, err := parseOptions(args)
+		assert.NotNil(t, err, args)
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		encoding string
+		expected Format
+	}{
+		{"logs/2020101104-00_uuid.gz", "", Format{Compression: "gzip"}},
+		{"logs/2020101104-00_uuid.txt", "", Format{}},
+		{"logs/2020101104-00_uuid.zst", "", Format{Compression: "zstd"}},
+		{"logs/2020101104-00_uuid.log", "gzip", Format{Compression: "gzip"}},
+		{"logs/2020101104-00_uuid.msgpack", "", Format{Msgpack: true}},
+		{"logs/2020101104-00_uuid.msgpack.gz", "", Format{Compression: "gzip", Msgpack: true}},
+	} {
+		f, err := DetectFormat(c.name, c.encoding)
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, f, c.name)
+	}
+
+	_, err := DetectFormat("logs/2020101104-00_uuid.parquet", "")
+	assert.NotNil(t, err)
+}
+
+func TestBlobDecoder(t *testing.T) {
+	modTime := time.Unix(1602388800, 0)
+
+	// Appended batches are gzip members of their own.
+	var b bytes.Buffer
+	for _, lines := range []string{
+		`{"log":"line1","time":"2020-10-11T04:00:01.5Z"}` + "\n",
+		"\n" + `{"log":"line2","code":200,"ratio":0.5}`,
+	} {
+		zw := gzip.NewWriter(&b)
+		zw.Write([]byte(lines))
+		zw.Close()
+	}
+
+	dec, err := NewBlobDecoder(&b, Format{Compression: "gzip"}, "time", modTime)
+	assert.Nil(t, err)
+
+	var events [][]byte
+	for {
+		event, err := dec.Next()
+		assert.Nil(t, err)
+		if event == nil {
+			break
+		}
+		events = append(events, event)
+	}
+	assert.Equal(t, 2, len(events))
+
+	var event []interface{}
+	assert.Nil(t, codec.NewDecoderBytes(events[0], msgpackHandle).Decode(&event))
+	ts := event[0].(codec.RawExt)
+	assert.Equal(t, []byte{0x5f, 0x82, 0x83, 0x41, 0x1d, 0xcd, 0x65, 0x00}, ts.Data)
+
+	event = nil
+	assert.Nil(t, codec.NewDecoderBytes(events[1], msgpackHandle).Decode(&event))
+	assert.Equal(t, []byte{0x5f, 0x82, 0x83, 0x40, 0, 0, 0, 0}, event[0].(codec.RawExt).Data)
+	record := event[1].(map[interface{}]interface{})
+	assert.Equal(t, []byte("line2"), record["log"])
+	assert.Equal(t, int64(200), record["code"])
+	assert.Equal(t, 0.5, record["ratio"])
+
+	// msgpack events are read verbatim.
+	chunk := append(append([]byte{}, events[0]...), events[1]...)
+	dec, err = NewBlobDecoder(bytes.NewReader(chunk), Format{Msgpack: true}, "", modTime)
+	assert.Nil(t, err)
+	for _, expected := range events {
+		event, err := dec.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, event)
+	}
+	event2, err := dec.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, event2)
+
+	// Lines which are not JSON records are skipped.
+	var zb bytes.Buffer
+	zw, err := zstd.NewWriter(&zb)
+	assert.Nil(t, err)
+	zw.Write([]byte("not json\n" + `{"log":"line3"}` + "\n"))
+	zw.Close()
+
+	dec, err = NewBlobDecoder(&zb, Format{Compression: "zstd"}, "", modTime)
+	assert.Nil(t, err)
+	defer dec.Close()
+	event3, err := dec.Next()
+	assert.Nil(t, err)
+	assert.NotNil(t, event3)
+	event3, err = dec.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, event3)
+	assert.Equal(t, 1, dec.Skipped)
+}
+
+func TestForwardClient(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	events := [][]byte{[]byte("\x92\x01\x81\xa3log\xa5line1"),
+		[]byte("\x92\x02\x81\xa3log\xa5line2")}
+
+	received := make(chan []interface{}, 2)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		dec := codec.NewDecoder(conn, msgpackHandle)
+		for i := 0; i < 2; i++ {
+			var message []interface{}
+			if err := dec.Decode(&message); err != nil {
+				return
+			}
+			received <- message
+
+			options := message[2].(map[interface{}]interface{})
+			ack := options["chunk"]
+			if i == 1 {
+				ack = "wrong"
+			}
+			var b []byte
+			codec.NewEncoderBytes(&b, msgpackHandle).Encode(
+				map[string]interface{}{"ack": ack})
+			conn.Write(b)
+		}
+	}()
+
+	c, err := DialForward(l.Addr().String(), true, time.Second)
+	assert.Nil(t, err)
+	defer c.Close()
+
+	assert.Nil(t, c.Send("replay", events))
+	message := <-received
+	assert.Equal(t, []byte("replay"), message[0])
+	entries := message[1].([]interface{})
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, []interface{}{int64(2), map[interface{}]interface{}{
+		"log": []byte("line2")}}, entries[1])
+
+	assert.NotNil(t, c.Send("replay", events))
+}
+
+func TestRunIncomplete(t *testing.T) {
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(`{"log":"line1"}` + "\n"))
+	zw.Close()
+	b.WriteString("not gzip")
+	blobs := map[string][]byte{
+		"logs/a.gz":  b.Bytes(),
+		"logs/b.txt": []byte(`{"log":"line2"}` + "\n"),
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Query().Get("comp") == "list" {
+				fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?>`+
+					`<EnumerationResults ContainerName="logs"><Blobs>`)
+				for _, name := range []string{"logs/a.gz", "logs/b.txt"} {
+					fmt.Fprintf(w, `<Blob><Name>%s</Name><Properties>`+
+						`<Last-Modified>Sun, 11 Oct 2020 04:00:00 GMT</Last-Modified>`+
+						`</Properties></Blob>`, name)
+				}
+				fmt.Fprint(w, `</Blobs><NextMarker/></EnumerationResults>`)
+				return
+			}
+			w.Write(blobs[strings.TrimPrefix(r.URL.Path, "/logs/")])
+		}))
+	defer ts.Close()
+
+	// The rest of the blobs is replayed, but the run fails.
+	o, err := parseOptions([]string{"-endpoint", ts.URL, "-container", "logs",
+		"-dry-run"})
+	assert.Nil(t, err)
+	err = run(o)
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "logs/a.gz"), err)
+	assert.False(t, strings.Contains(err.Error(), "logs/b.txt"), err)
+
+	// An empty blob is complete, unlike one which is not gzip.
+	blobs["logs/a.gz"] = []byte{}
+	assert.Nil(t, run(o))
+	blobs["logs/a.gz"] = []byte("not gzip")
+	assert.NotNil(t, run(o))
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+	MaxAppendBlobSize = azblob.AppendBlobMaxAppendBlockBytes * azblob.AppendBlobMaxBlocks
+	AppendTargetTTL   = time.Hour
+)
+
+// AppendTarget is the append blob currently written for an object key.
+type AppendTarget struct {
+	mu       sync.Mutex
+	name     string
+	seq      int
+	blocks   int
+	size     int64
+	lastUsed time.Time
+}
+
+// appendTarget returns the target of an object key, and forgets the targets
+// which have not been written for a while.
+func (u *AzblobUploader) appendTarget(key string) *AppendTarget {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	for k, t := range u.appendTargets {
+		if now.Sub(t.lastUsed) > AppendTargetTTL {
+			delete(u.appendTargets, k)
+		}
+	}
+
+	t, ok := u.appendTargets[key]
+	if !ok {
+		t = &AppendTarget{}
+		u.appendTargets[key] = t
+	}
+	t.lastUsed = now
+
+	return t
+}
+
+// appendBlob appends b to the append blob of the target, creating the blob on
+// first use and rolling to a new one when it is full. Bytes already appended
+// by a previous attempt are tracked in written and skipped. The caller holds
+// t.mu for all the attempts of a batch, so that a batch is never split across
+// blobs or interleaved with another one.
+func (u *AzblobUploader) appendBlob(t *AppendTarget, key string, b []byte,
+	written *int) error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), Timeout*time.Second)
+	defer cancel()
+
+	if u.config.AutoCreateContainer {
+		err := u.ensureContainer(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	blocks := (len(b) + azblob.AppendBlobMaxAppendBlockBytes - 1) /
+		azblob.AppendBlobMaxAppendBlockBytes
+
+	for *written == 0 && (t.name == "" || u.appendBlobFull(t, blocks, len(b))) {
+		if t.name != "" {
+			u.logger.Infof("append blob full, blob=%s blocks=%d size=%d",
+				t.name, t.blocks, t.size)
+			t.seq++
+		}
+
+		if err := u.openAppendBlob(ctx, t, appendBlobName(key, t.seq)); err != nil {
+			t.name = ""
+			return err
+		}
+	}
+
+	blobURL := u.containerURL().NewAppendBlobURL(t.name)
+	for *written < len(b) {
+		end := *written + azblob.AppendBlobMaxAppendBlockBytes
+		if end > len(b) {
+			end = len(b)
+		}
+
+		if err := u.appendBlock(ctx, t, blobURL, b[*written:end]); err != nil {
+			u.logger.Errorf("append to blob error: %s", err.Error())
+			return err
+		}
+
+		t.blocks++
+		t.size += int64(end - *written)
+		*written = end
+	}
+
+	return nil
+}
+
+// appendBlock appends a block at the known end of the blob. A block which
+// has been appended by an attempt whose response was lost fails the position
+// condition, and is found at the end of the blob.
+func (u *AzblobUploader) appendBlock(ctx context.Context, t *AppendTarget,
+	blobURL azblob.AppendBlobURL, block []byte) error {
+	// -1 is the condition of position 0.
+	position := t.size
+	if position == 0 {
+		position = -1
+	}
+
+	_, err := blobURL.AppendBlock(ctx, bytes.NewReader(block),
+		azblob.AppendBlobAccessConditions{
+			AppendPositionAccessConditions: azblob.AppendPositionAccessConditions{
+				IfAppendPositionEqual: position,
+			},
+		}, nil)
+	serr, ok := err.(azblob.StorageError)
+	if !ok || serr.ServiceCode() != azblob.ServiceCodeAppendPositionConditionNotMet {
+		return err
+	}
+
+	props, perr := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if perr != nil {
+		return err
+	}
+	if props.ContentLength() == t.size+int64(len(block)) &&
+		u.appendedBlock(ctx, blobURL, t.size, block) {
+		u.logger.Debugf("block already appended, blob=%s size=%d",
+			t.name, props.ContentLength())
+		return nil
+	}
+
+	// The blob has been written by someone else, the next attempt appends
+	// at its new end.
+	t.blocks = int(props.BlobCommittedBlockCount())
+	t.size = props.ContentLength()
+
+	return err
+}
+
+// appendedBlock reports whether the blob holds the block at offset.
+func (u *AzblobUploader) appendedBlock(ctx context.Context,
+	blobURL azblob.AppendBlobURL, offset int64, block []byte) bool {
+	resp, err := blobURL.Download(ctx, offset, int64(len(block)),
+		azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		return false
+	}
+	body := resp.Body(azblob.RetryReaderOptions{})
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(body)
+	return err == nil && bytes.Equal(b, block)
+}
+
+func (u *AzblobUploader) appendBlobFull(t *AppendTarget, blocks, size int) bool {
+	maxSize := int64(MaxAppendBlobSize)
+	if u.config.MaxBlobSize > 0 {
+		maxSize = int64(u.config.MaxBlobSize)
+	}
+
+	// An empty blob always takes the batch, even if it exceeds Max_Blob_Size.
+	if t.blocks == 0 {
+		return false
+	}
+
+	return t.blocks+blocks > azblob.AppendBlobMaxBlocks ||
+		t.size+int64(size) > maxSize
+}
+
+// openAppendBlob creates the append blob, or picks up the size of the blob if
+// it has been created by a previous run.
+func (u *AzblobUploader) openAppendBlob(
+	ctx context.Context, t *AppendTarget, name string) error {
+	blobURL := u.containerURL().NewAppendBlobURL(name)
+
+	_, err := blobURL.Create(ctx, azblob.BlobHTTPHeaders{
+		ContentEncoding: u.config.StoreAs.ContentEncoding(),
+	}, azblob.Metadata{},
+		azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+				IfNoneMatch: azblob.ETagAny,
+			},
+		})
+	if err == nil {
+		u.logger.Debugf("create append blob=%s", name)
+		t.name, t.blocks, t.size = name, 0, 0
+		return nil
+	}
+
+	if serr, ok := err.(azblob.StorageError); !ok ||
+		serr.ServiceCode() != azblob.ServiceCodeBlobAlreadyExists {
+		u.logger.Errorf("create append blob error: %s", err.Error())
+		return err
+	}
+
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return err
+	}
+	if props.BlobType() != azblob.BlobAppendBlob {
+		return fmt.Errorf("blob %s exists and is not an append blob", name)
+	}
+
+	u.logger.Debugf("reuse append blob=%s blocks=%d size=%d",
+		name, props.BlobCommittedBlockCount(), props.ContentLength())
+	t.name = name
+	t.blocks = int(props.BlobCommittedBlockCount())
+	t.size = props.ContentLength()
+
+	return nil
+}
+
+// appendBlobName renders the blob name of the seq-th blob of an object key.
+// %{index} is the sequence number and a new %{uuid} or %{ulid} is generated
+// for every blob. Without them, a sequence number is inserted before the
+// extension.
+func appendBlobName(key string, seq int) string {
+	if strings.Contains(key, "%{index}") {
+		key = strings.ReplaceAll(key, "%{index}", strconv.Itoa(seq))
+		return renderUnique(key)
+	}
+	if hasUniqueName(key) {
+		return renderUnique(key)
+	}
+
+	if seq == 0 {
+		return key
+	}
+
+	if i := strings.LastIndex(key, "."); i > strings.LastIndex(key, "/") {
+		return fmt.Sprintf("%s_%d%s", key[:i], seq, key[i:])
+	}
+
+	return fmt.Sprintf("%s_%d", key, seq)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	StorageResource      = "https://storage.azure.com/"
+	DefaultIMDSEndpoint  = "http://169.254.169.254/metadata/identity/oauth2/token"
+	IMDSAPIVersion       = "2018-02-01"
+	TokenRefreshMargin   = 5 * time.Minute
+	TokenRetryInterval   = 30 * time.Second
+	MinTokenRefresh      = time.Second
+	DefaultTokenExpiry   = time.Hour
+	DefaultAuthorityHost = "https://login.microsoftonline.com/"
+	StorageScope         = "https://storage.azure.com/.default"
+	ClientAssertionType  = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	AssertionLifetime    = 10 * time.Minute
+)
+
+type AuthMode string
+
+const (
+	SharedKeyAuth        AuthMode = "key"
+	ManagedIdentityAuth  AuthMode = "managed_identity"
+	ServicePrincipalAuth AuthMode = "service_principal"
+	WorkloadIdentityAuth AuthMode = "workload_identity"
+)
+
+// Token is an OAuth access token issued by Azure AD.
+type Token struct {
+	AccessToken string
+	ExpiresOn   time.Time
+}
+
+// TokenSource fetches a new access token.
+type TokenSource func() (*Token, error)
+
+type tokenResponse struct {
+	AccessToken      string      `json:"access_token"`
+	ExpiresIn        json.Number `json:"expires_in"`
+	ExpiresOn        json.Number `json:"expires_on"`
+	Error            string      `json:"error"`
+	ErrorDescription string      `json:"error_description"`
+}
+
+var tokenClient = &http.Client{Timeout: Timeout * time.Second}
+
+// IMDSTokenSource fetches tokens of the managed identity of the host from the
+// Azure Instance Metadata Service. The client ID selects a user-assigned
+// identity, the system-assigned one is used if it is empty.
+func IMDSTokenSource(endpoint, clientID string) TokenSource {
+	if endpoint == "" {
+		endpoint = DefaultIMDSEndpoint
+	}
+
+	return func() (*Token, error) {
+		params := url.Values{}
+		params.Set("api-version", IMDSAPIVersion)
+		params.Set("resource", StorageResource)
+		if clientID != "" {
+			params.Set("client_id", clientID)
+		}
+
+		req, err := http.NewRequest("GET", endpoint+"?"+params.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+
+		return requestToken(req)
+	}
+}
+
+// ClientSecretTokenSource fetches tokens of a service principal with the
+// client credentials flow of Azure AD, authenticated by a client secret.
+func ClientSecretTokenSource(
+	authority, tenantID, clientID, secret string) TokenSource {
+	return clientCredentialsTokenSource(authority, tenantID, clientID,
+		func(string) (url.Values, error) {
+			return url.Values{"client_secret": {secret}}, nil
+		})
+}
+
+// ClientCertificateTokenSource fetches tokens of a service principal with the
+// client credentials flow of Azure AD, authenticated by an assertion signed
+// with the private key of a certificate. The PEM file at path must contain
+// both the certificate and its RSA private key.
+func ClientCertificateTokenSource(
+	authority, tenantID, clientID, path string) (TokenSource, error) {
+	cert, key, err := loadCertificate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return clientCredentialsTokenSource(authority, tenantID, clientID,
+		func(endpoint string) (url.Values, error) {
+			assertion, err := clientAssertion(cert, key, endpoint, clientID)
+			if err != nil {
+				return nil, err
+			}
+
+			return url.Values{
+				"client_assertion_type": {ClientAssertionType},
+				"client_assertion":      {assertion},
+			}, nil
+		}), nil
+}
+
+// FederatedTokenSource exchanges the federated token in the file at path,
+// e.g. a projected service account token, for an Azure AD token. The file is
+// read on every request, so that rotated tokens are picked up.
+func FederatedTokenSource(
+	authority, tenantID, clientID, path string) TokenSource {
+	return clientCredentialsTokenSource(authority, tenantID, clientID,
+		func(string) (url.Values, error) {
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("read federated token error: %v", err)
+			}
+
+			return url.Values{
+				"client_assertion_type": {ClientAssertionType},
+				"client_assertion":      {strings.TrimSpace(string(b))},
+			}, nil
+		})
+}
+
+// clientCredentialsTokenSource requests tokens from the token endpoint of
+// the tenant. credentials returns the form parameters authenticating the
+// client for the given token endpoint.
+func clientCredentialsTokenSource(authority, tenantID, clientID string,
+	credentials func(endpoint string) (url.Values, error)) TokenSource {
+	if authority == "" {
+		authority = DefaultAuthorityHost
+	}
+	endpoint := fmt.Sprintf("%s/%s/oauth2/v2.0/token",
+		strings.TrimSuffix(authority, "/"), tenantID)
+
+	return func() (*Token, error) {
+		form, err := credentials(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		form.Set("grant_type", "client_credentials")
+		form.Set("client_id", clientID)
+		form.Set("scope", StorageScope)
+
+		req, err := http.NewRequest(
+			"POST", endpoint, strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		return requestToken(req)
+	}
+}
+
+func loadCertificate(path string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cert *x509.Certificate
+	var key *rsa.PrivateKey
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "CERTIFICATE":
+			if cert == nil {
+				cert, err = x509.ParseCertificate(block.Bytes)
+			}
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			var k interface{}
+			k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+			if rk, ok := k.(*rsa.PrivateKey); ok {
+				key = rk
+			} else if err == nil {
+				err = fmt.Errorf("private key is not an RSA key")
+			}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid certificate %s: %v", path, err)
+		}
+	}
+
+	if cert == nil || key == nil {
+		return nil, nil, fmt.Errorf(
+			"certificate %s must contain a certificate and a private key", path)
+	}
+
+	return cert, key, nil
+}
+
+// clientAssertion creates the signed JWT a client authenticates with instead
+// of a secret.
+func clientAssertion(cert *x509.Certificate, key *rsa.PrivateKey,
+	audience, clientID string) (string, error) {
+	thumbprint := sha1.Sum(cert.Raw)
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": clientID,
+		"sub": clientID,
+		"jti": uuid.NewV4().String(),
+		"nbf": now.Unix(),
+		"exp": now.Add(AssertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(claims)
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func requestToken(req *http.Request) (*Token, error) {
+	resp, err := tokenClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, fmt.Errorf(
+			"invalid token response, status=%d: %v", resp.StatusCode, err)
+	}
+
+	if resp.StatusCode != http.StatusOK || tr.AccessToken == "" {
+		return nil, fmt.Errorf("token request failed, status=%d error=%s %s",
+			resp.StatusCode, tr.Error, tr.ErrorDescription)
+	}
+
+	token := &Token{AccessToken: tr.AccessToken}
+	if in, err := tr.ExpiresIn.Int64(); err == nil {
+		token.ExpiresOn = time.Now().Add(time.Duration(in) * time.Second)
+	} else if on, err := strconv.ParseInt(tr.ExpiresOn.String(), 10, 64); err == nil {
+		token.ExpiresOn = time.Unix(on, 0)
+	} else {
+		token.ExpiresOn = time.Now().Add(DefaultTokenExpiry)
+	}
+
+	return token, nil
+}
+
+// TokenRefresher keeps the token of a credential fresh in the background.
+// The first token is fetched in the background as well, so that an outage of
+// the token endpoint at startup fails the uploads, which are retried, instead
+// of the plugin.
+type TokenRefresher struct {
+	credential azblob.TokenCredential
+	source     TokenSource
+	logger     *logrus.Entry
+	quit       chan struct{}
+	wg         sync.WaitGroup
+}
+
+func NewTokenRefresher(credential azblob.TokenCredential, source TokenSource,
+	l *logrus.Entry) *TokenRefresher {
+	r := &TokenRefresher{
+		credential: credential,
+		source:     source,
+		logger:     l,
+		quit:       make(chan struct{}),
+	}
+
+	r.wg.Add(1)
+	go r.run()
+
+	return r
+}
+
+func (r *TokenRefresher) run() {
+	defer r.wg.Done()
+
+	for {
+		timer := time.NewTimer(r.refresh())
+		select {
+		case <-timer.C:
+		case <-r.quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// refresh fetches a token and returns when to fetch the next one.
+func (r *TokenRefresher) refresh() time.Duration {
+	token, err := r.source()
+	if err != nil {
+		r.logger.Warnf("refresh token error: %v", err)
+		return TokenRetryInterval
+	}
+
+	r.logger.Debugf("token refreshed, expires_on=%v", token.ExpiresOn)
+	r.credential.SetToken(token.AccessToken)
+
+	return refreshIn(token.ExpiresOn)
+}
+
+func (r *TokenRefresher) Stop() {
+	close(r.quit)
+	r.wg.Wait()
+}
+
+// refreshIn returns when a token expiring at expiresOn should be refreshed.
+// Short-lived tokens are refreshed at half of their remaining lifetime.
+func refreshIn(expiresOn time.Time) time.Duration {
+	ttl := time.Until(expiresOn)
+
+	d := ttl - TokenRefreshMargin
+	if d < ttl/2 {
+		d = ttl / 2
+	}
+	if d < MinTokenRefresh {
+		d = MinTokenRefresh
+	}
+
+	return d
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/linkedin/goavro/v2"
+)
+
+// AvroBlockCount is the number of records of an OCF block.
+const AvroBlockCount = 1000
+
+// AvroEventSchema is the schema of the blobs without Avro_Schema_File. The
+// values of record are encoded as JSON, except for strings.
+const AvroEventSchema = `{
+  "type": "record",
+  "name": "Event",
+  "namespace": "fluentbit",
+  "fields": [
+    {"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+    {"name": "tag", "type": "string"},
+    {"name": "record", "type": {"type": "map", "values": "string"}}
+  ]
+}`
+
+var avroEventCodec = mustAvroCodec(AvroEventSchema)
+
+func mustAvroCodec(schema string) *goavro.Codec {
+	codec, err := goavro.NewCodec(schema)
+	if err != nil {
+		panic(err)
+	}
+
+	return codec
+}
+
+// AvroSchema is the schema of Avro_Schema_File. Records are converted to the
+// native values of goavro for it, with the values of unions wrapped in the
+// type of the first member they match.
+type AvroSchema struct {
+	Codec *goavro.Codec
+	root  interface{}
+	// names holds the named types by their full names.
+	names map[string]map[string]interface{}
+	// fields are the field names of a record schema.
+	fields map[string]bool
+}
+
+var avroLogicalTypes = map[string]bool{
+	"int.date": true, "int.time-millis": true, "long.time-micros": true,
+	"long.timestamp-millis": true, "long.timestamp-micros": true,
+	"bytes.decimal": true,
+}
+
+// LoadAvroSchema reads the schema of the blobs.
+func LoadAvroSchema(path string) (*AvroSchema, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := goavro.NewCodec(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", path, err)
+	}
+
+	s := &AvroSchema{Codec: codec, names: map[string]map[string]interface{}{}}
+	if err := json.Unmarshal(b, &s.root); err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", path, err)
+	}
+	s.register(s.root, "")
+
+	s.fields = map[string]bool{}
+	if root, ok := s.root.(map[string]interface{}); ok {
+		fields, _ := root["fields"].([]interface{})
+		for _, f := range fields {
+			if field, ok := f.(map[string]interface{}); ok {
+				name, _ := field["name"].(string)
+				s.fields[name] = true
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// register collects the named types of a schema, which goavro has validated.
+func (s *AvroSchema) register(schema interface{}, ns string) {
+	switch t := schema.(type) {
+	case []interface{}:
+		for _, member := range t {
+			s.register(member, ns)
+		}
+	case map[string]interface{}:
+		switch t["type"] {
+		case "record", "enum", "fixed":
+			name := avroFullName(t, ns)
+			s.names[name] = t
+			ns = avroNamespace(name)
+		case "array":
+			s.register(t["items"], ns)
+		case "map":
+			s.register(t["values"], ns)
+		default:
+			s.register(t["type"], ns)
+		}
+		if fields, ok := t["fields"].([]interface{}); ok {
+			for _, f := range fields {
+				if f, ok := f.(map[string]interface{}); ok {
+					s.register(f["type"], ns)
+				}
+			}
+		}
+	}
+}
+
+func avroFullName(schema map[string]interface{}, ns string) string {
+	name, _ := schema["name"].(string)
+	if strings.Contains(name, ".") {
+		return name
+	}
+	if v, ok := schema["namespace"].(string); ok && v != "" {
+		ns = v
+	}
+	if ns == "" {
+		return name
+	}
+
+	return ns + "." + name
+}
+
+func avroNamespace(fullName string) string {
+	if i := strings.LastIndex(fullName, "."); i >= 0 {
+		return fullName[:i]
+	}
+
+	return ""
+}
+
+// Native converts a JSON encoded record to the native value of goavro.
+func (s *AvroSchema) Native(raw []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return s.native(s.root, "", v)
+}
+
+func (s *AvroSchema) native(schema interface{}, ns string, v interface{}) (
+	interface{}, error) {
+	switch t := schema.(type) {
+	case string:
+		if named, ok := s.lookup(t, ns); ok {
+			return s.native(named, avroNamespace(avroFullName(named, ns)), v)
+		}
+		return avroPrimitive(t, v)
+	case []interface{}:
+		return s.nativeUnion(t, ns, v)
+	case map[string]interface{}:
+		return s.nativeComplex(t, ns, v)
+	}
+
+	return nil, fmt.Errorf("invalid schema %v", schema)
+}
+
+// lookup resolves a reference to a named type.
+func (s *AvroSchema) lookup(name, ns string) (map[string]interface{}, bool) {
+	if ns != "" && !strings.Contains(name, ".") {
+		if named, ok := s.names[ns+"."+name]; ok {
+			return named, true
+		}
+	}
+	named, ok := s.names[name]
+
+	return named, ok
+}
+
+func (s *AvroSchema) nativeUnion(members []interface{}, ns string,
+	v interface{}) (interface{}, error) {
+	for _, member := range members {
+		if member == "null" {
+			if v == nil {
+				return nil, nil
+			}
+			continue
+		}
+
+		datum, err := s.native(member, ns, v)
+		if err == nil {
+			return goavro.Union(s.memberName(member, ns), datum), nil
+		}
+	}
+
+	return nil, fmt.Errorf("%v matches no member of union %v", v, members)
+}
+
+// memberName is the name of a union member in goavro.
+func (s *AvroSchema) memberName(member interface{}, ns string) string {
+	switch t := member.(type) {
+	case string:
+		if named, ok := s.lookup(t, ns); ok {
+			return avroFullName(named, ns)
+		}
+		return t
+	case map[string]interface{}:
+		typ, ok := t["type"].(string)
+		if !ok {
+			return s.memberName(t["type"], ns)
+		}
+		switch typ {
+		case "record", "enum", "fixed":
+			return avroFullName(t, ns)
+		}
+		if lt, ok := t["logicalType"].(string); ok && avroLogicalTypes[typ+"."+lt] {
+			return typ + "." + lt
+		}
+		return s.memberName(typ, ns)
+	}
+
+	return ""
+}
+
+func (s *AvroSchema) nativeComplex(schema map[string]interface{}, ns string,
+	v interface{}) (interface{}, error) {
+	typ, ok := schema["type"].(string)
+	if !ok {
+		return s.native(schema["type"], ns, v)
+	}
+
+	switch typ {
+	case "record":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected record, got %T", v)
+		}
+		ns = avroNamespace(avroFullName(schema, ns))
+
+		out := map[string]interface{}{}
+		fields, _ := schema["fields"].([]interface{})
+		for _, f := range fields {
+			field, _ := f.(map[string]interface{})
+			name, _ := field["name"].(string)
+			value, ok := m[name]
+			if _, hasDefault := field["default"]; !ok && hasDefault {
+				continue
+			}
+
+			datum, err := s.native(field["type"], ns, value)
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %v", name, err)
+			}
+			out[name] = datum
+		}
+		return out, nil
+	case "enum":
+		symbol, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected enum symbol, got %T", v)
+		}
+		symbols, _ := schema["symbols"].([]interface{})
+		for _, s := range symbols {
+			if s == symbol {
+				return symbol, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown enum symbol %s", symbol)
+	case "fixed":
+		str, ok := v.(string)
+		size, _ := schema["size"].(float64)
+		if !ok || len(str) != int(size) {
+			return nil, fmt.Errorf("expected %v bytes", size)
+		}
+		return []byte(str), nil
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected array, got %T", v)
+		}
+		out := make([]interface{}, len(items))
+		for i, item := range items {
+			datum, err := s.native(schema["items"], ns, item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = datum
+		}
+		return out, nil
+	case "map":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("expected map, got %T", v)
+		}
+		out := make(map[string]interface{}, len(m))
+		for k, value := range m {
+			datum, err := s.native(schema["values"], ns, value)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = datum
+		}
+		return out, nil
+	}
+
+	if schema["logicalType"] == "decimal" && typ == "bytes" {
+		n, ok := v.(json.Number)
+		r, valid := new(big.Rat).SetString(string(n))
+		if !ok || !valid {
+			return nil, fmt.Errorf("expected decimal, got %v", v)
+		}
+		return r, nil
+	}
+
+	return s.native(typ, ns, v)
+}
+
+// avroPrimitive converts a JSON value to a primitive type. Times in RFC 3339
+// are taken by the long and int types, for their logical time types.
+func avroPrimitive(typ string, v interface{}) (interface{}, error) {
+	if str, ok := v.(string); ok && (typ == "long" || typ == "int") {
+		if t, err := time.Parse(time.RFC3339Nano, str); err == nil {
+			return t, nil
+		}
+	}
+
+	switch typ {
+	case "null":
+		if v == nil {
+			return nil, nil
+		}
+	case "boolean":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+	case "int":
+		if n, ok := v.(json.Number); ok {
+			i, err := strconv.ParseInt(string(n), 10, 32)
+			if err == nil {
+				return int32(i), nil
+			}
+		}
+	case "long":
+		if n, ok := v.(json.Number); ok {
+			i, err := n.Int64()
+			if err == nil {
+				return i, nil
+			}
+		}
+	case "float", "double":
+		if n, ok := v.(json.Number); ok {
+			f, err := n.Float64()
+			if err == nil && typ == "float" {
+				return float32(f), nil
+			}
+			if err == nil {
+				return f, nil
+			}
+		}
+	case "string":
+		if str, ok := v.(string); ok {
+			return str, nil
+		}
+	case "bytes":
+		if str, ok := v.(string); ok {
+			return []byte(str), nil
+		}
+	default:
+		return nil, fmt.Errorf("unknown type %s", typ)
+	}
+
+	return nil, fmt.Errorf("expected %s, got %v", typ, v)
+}
+
+// createAvroEvent encodes a record as an event of AvroEventSchema.
+func createAvroEvent(record map[interface{}]interface{},
+	ts time.Time, tag string) ([]byte, error) {
+	values := map[string]string{}
+	for k, v := range encodeJSON(record) {
+		if s, ok := v.(string); ok {
+			values[k] = s
+			continue
+		}
+
+		js, err := jsoniter.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		values[k] = string(js)
+	}
+
+	return jsoniter.Marshal(map[string]interface{}{
+		"timestamp": ts.UnixNano() / int64(time.Millisecond),
+		"tag":       tag,
+		"record":    values,
+	})
+}
+
+// createAvroRecord encodes a record for Avro_Schema_File. As in
+// AvroEventSchema, the timestamp and tag fields of the schema are the time and
+// tag of the event, unless the record has them.
+func createAvroRecord(s *AvroSchema, record map[interface{}]interface{},
+	ts time.Time, tag string) ([]byte, error) {
+	m := encodeJSON(record)
+	if _, ok := m["timestamp"]; !ok && s.fields["timestamp"] {
+		m["timestamp"] = ts.UTC().Format(time.RFC3339Nano)
+	}
+	if _, ok := m["tag"]; !ok && s.fields["tag"] {
+		m["tag"] = tag
+	}
+
+	return jsoniter.Marshal(m)
+}
+
+// avroWriter writes a batch as an Avro object container file, which embeds
+// the schema of its records.
+type avroWriter struct {
+	buf         bytes.Buffer
+	ocf         *goavro.OCFWriter
+	schema      *AvroSchema
+	pending     []interface{}
+	pendingSize int
+}
+
+func newAvroWriter(c *AzblobConfig) (*avroWriter, error) {
+	w := &avroWriter{schema: c.AvroSchema}
+	codec := avroEventCodec
+	if c.AvroSchema != nil {
+		codec = c.AvroSchema.Codec
+	}
+
+	ocf, err := goavro.NewOCFWriter(goavro.OCFConfig{
+		W:               &w.buf,
+		Codec:           codec,
+		CompressionName: c.AvroCompression,
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.ocf = ocf
+
+	return w, nil
+}
+
+func (w *avroWriter) Write(raw []byte) error {
+	var datum interface{}
+	var err error
+	if w.schema != nil {
+		datum, err = w.schema.Native(raw)
+	} else {
+		datum, _, err = w.ocf.Codec().NativeFromTextual(raw)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid avro record: %v", err)
+	}
+	// A datum failing to encode would fail its whole block.
+	b, err := w.ocf.Codec().BinaryFromNative(nil, datum)
+	if err != nil {
+		return fmt.Errorf("invalid avro record: %v", err)
+	}
+
+	w.pending = append(w.pending, datum)
+	w.pendingSize += len(b)
+	if len(w.pending) < AvroBlockCount {
+		return nil
+	}
+
+	return w.flush()
+}
+
+func (w *avroWriter) flush() error {
+	if len(w.pending) == 0 {
+		return nil
+	}
+
+	err := w.ocf.Append(w.pending)
+	w.pending, w.pendingSize = nil, 0
+
+	return err
+}
+
+// Size includes the records of the block being filled.
+func (w *avroWriter) Size() int {
+	return w.buf.Len() + w.pendingSize
+}
+
+func (w *avroWriter) Close() ([]byte, error) {
+	if err := w.flush(); err != nil {
+		return nil, err
+	}
+
+	return w.buf.Bytes(), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	SegmentExt      = ".seg"
+	StagedDir       = "staged"
+	MaxSegmentFrame = 64 * 1024 * 1024 // 64m
+)
+
+// SegmentHeader is stored as the first frame of every segment file and
+// describes the batch the journaled entries belong to.
+type SegmentHeader struct {
+	Tag       string    `json:"tag,omitempty"`
+	Key       string    `json:"key,omitempty"`
+	TimeSlice string    `json:"time_slice"`
+	Time      time.Time `json:"time"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Segment is the on-disk journal of a single batch. Every entry is written as
+// a 4-byte big-endian length followed by the raw entry.
+type Segment struct {
+	Header SegmentHeader
+	path   string
+	file   *os.File
+}
+
+// FileBuffer keeps batches in segment files under a local directory, so that
+// entries which have not been uploaded yet survive a crash or restart.
+type FileBuffer struct {
+	dir string
+}
+
+func NewFileBuffer(dir string) (*FileBuffer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create buffer directory error: %v", err)
+	}
+
+	return &FileBuffer{dir: dir}, nil
+}
+
+// Create opens a new segment file and writes its header.
+func (fb *FileBuffer) Create(h SegmentHeader) (*Segment, error) {
+	name := fmt.Sprintf(
+		"%d-%s%s", time.Now().UnixNano(), uuid.NewV4().String(), SegmentExt)
+	path := filepath.Join(fb.dir, name)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Segment{Header: h, path: path, file: f}
+
+	header, err := json.Marshal(h)
+	if err != nil {
+		s.Remove()
+		return nil, err
+	}
+	if err := s.Append(header); err != nil {
+		s.Remove()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Segments returns the segment files left in the buffer directory, oldest
+// first.
+func (fb *FileBuffer) Segments() ([]string, error) {
+	files, err := ioutil.ReadDir(fb.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), SegmentExt) {
+			continue
+		}
+		paths = append(paths, filepath.Join(fb.dir, f.Name()))
+	}
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// Append journals a single entry. The write goes straight to the file so that
+// it is kept by the kernel even if the process gets killed.
+func (s *Segment) Append(raw []byte) error {
+	frame := make([]byte, 4+len(raw))
+	binary.BigEndian.PutUint32(frame, uint32(len(raw)))
+	copy(frame[4:], raw)
+
+	_, err := s.file.Write(frame)
+	return err
+}
+
+// Seal flushes the segment to stable storage and closes it. No more entries
+// can be appended afterwards.
+func (s *Segment) Seal() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	s.file = nil
+
+	return err
+}
+
+// Remove closes the segment and deletes it from disk.
+func (s *Segment) Remove() error {
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	return os.Remove(s.path)
+}
+
+func (s *Segment) Path() string {
+	return s.path
+}
+
+// SaveStaged persists the uncommitted blocks of a staged target. The file is
+// replaced atomically, so that a crash never leaves a partial block list.
+func (fb *FileBuffer) SaveStaged(t *StagedTarget) error {
+	dir := filepath.Join(fb.dir, StagedDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	path := fb.stagedPath(t)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// RemoveStaged deletes the persisted blocks of a committed target.
+func (fb *FileBuffer) RemoveStaged(t *StagedTarget) error {
+	err := os.Remove(fb.stagedPath(t))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// LoadStaged returns the staged targets persisted by a previous run.
+func (fb *FileBuffer) LoadStaged() ([]*StagedTarget, error) {
+	files, err := ioutil.ReadDir(filepath.Join(fb.dir, StagedDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []*StagedTarget
+	for _, f := range files {
+		if filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+
+		b, err := ioutil.ReadFile(filepath.Join(fb.dir, StagedDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		t := &StagedTarget{}
+		if err := json.Unmarshal(b, t); err != nil {
+			return nil, fmt.Errorf("invalid staged blocks %s: %v", f.Name(), err)
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
+
+func (fb *FileBuffer) stagedPath(t *StagedTarget) string {
+	sum := sha1.Sum([]byte(t.Key))
+	return filepath.Join(fb.dir, StagedDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// ReadSegment loads a sealed segment and its entries. A truncated trailing
+// frame, left by a crash in the middle of a write, is ignored.
+func ReadSegment(path string) (*Segment, [][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var frames [][]byte
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(f, size[:]); err != nil {
+			break
+		}
+
+		n := binary.BigEndian.Uint32(size[:])
+		if n > MaxSegmentFrame {
+			return nil, nil, fmt.Errorf("corrupted segment %s", path)
+		}
+
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(f, frame); err != nil {
+			break
+		}
+		frames = append(frames, frame)
+	}
+
+	if len(frames) == 0 {
+		return nil, nil, fmt.Errorf("missing header in segment %s", path)
+	}
+
+	s := &Segment{path: path}
+	if err := json.Unmarshal(frames[0], &s.Header); err != nil {
+		return nil, nil, fmt.Errorf("invalid header in segment %s: %v", path, err)
+	}
+
+	return s, frames[1:], nil
+}
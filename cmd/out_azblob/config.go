@@ -1,24 +1,34 @@
 package main
 
 import (
+	"compress/gzip"
 	"fmt"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"code.cloudfoundry.org/bytefmt"
 	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/linkedin/goavro/v2"
 	"github.com/sirupsen/logrus"
+	"github.com/xitongsys/parquet-go/parquet"
 )
 
 // Default configuration
 const (
 	DefaultObjectKeyFormat = "%{path}%{time_slice}_%{uuid}.%{file_extension}"
 	DefaultTimeSliceFormat = "2006010215-04"
+	DefaultEndpointSuffix  = "core.windows.net"
 	DefaultLogLevel        = "info"
 	DefaultBatchWait       = 5 * time.Second
 	DefaultBatchLimitSize  = 32 * 1024 // 32k
+	DefaultBufferRetry     = time.Minute
+	DefaultSyncRetryLimit  = 3
+	DefaultZstdLevel       = 3
+	MaxZstdLevel           = 22
 )
 
 type FileFormat string
@@ -26,19 +36,89 @@ type FileFormat string
 const (
 	PlainTextFormat FileFormat = "txt"
 	GzipFormat      FileFormat = "gz"
+	ZstdFormat      FileFormat = "zst"
+	ParquetFormat   FileFormat = "parquet"
+	AvroFormat      FileFormat = "avro"
+	CSVFormat       FileFormat = "csv"
+	TSVFormat       FileFormat = "tsv"
+	MsgpackFormat   FileFormat = "msgpack"
+)
+
+// ContentEncoding returns the Content-Encoding of the blobs of a format.
+func (f FileFormat) ContentEncoding() string {
+	switch f {
+	case GzipFormat:
+		return "gzip"
+	case ZstdFormat:
+		return "zstd"
+	}
+
+	return ""
+}
+
+type BlobType string
+
+const (
+	BlockBlobType  BlobType = "block"
+	AppendBlobType BlobType = "append"
+	StagedBlobType BlobType = "staged"
+)
+
+type KeyLayout string
+
+const (
+	FlatKeyLayout KeyLayout = "flat"
+	HiveKeyLayout KeyLayout = "hive"
+)
+
+type DeliveryMode string
+
+const (
+	AsyncDelivery DeliveryMode = "async"
+	SyncDelivery  DeliveryMode = "sync"
 )
 
 type AzblobConfig struct {
 	ContainerURL        azblob.ContainerURL
+	SecretFile          string
+	Secret              string
+	SecretRefresh       time.Duration
 	AutoCreateContainer bool
 	StoreAs             FileFormat
+	CompressionLevel    int
+	ParquetCodec        parquet.CompressionCodec
+	ParquetSchema       *ParquetSchema
+	AvroCompression     string
+	AvroSchema          *AvroSchema
+	Columns             []Column
+	HeaderRow           bool
+	NestedValues        NestedValues
+	FormatTemplate      *template.Template
+	BlobType            BlobType
+	MaxBlobSize         uint64
+	KeyLayout           KeyLayout
 	ObjectKeyFormat     string
+	Hostname            string
+	KeyFields           []KeyField
+	KeyFallback         string
 	TimeSliceFormat     string
 	BatchWait           time.Duration
 	BatchLimitSize      uint64
 	BatchRetryLimit     *uint64
+	BufferPath          string
+	BufferRetry         time.Duration
+	DeliveryMode        DeliveryMode
 	Location            *time.Location
 	LogLevel            logrus.Level
+
+	// SecondaryContainerURL is used when ContainerURL fails to authenticate.
+	SecondaryContainerURL *azblob.ContainerURL
+	// TokenSource refreshes TokenCredential, the credential of the token
+	// auth modes.
+	TokenSource     TokenSource
+	TokenCredential azblob.TokenCredential
+	// ContainerURLFromSecret rebuilds ContainerURL when SecretFile changes.
+	ContainerURLFromSecret func(secret string) (azblob.ContainerURL, error)
 }
 
 func NewConfig(c PluginConfig) (*AzblobConfig, error) {
@@ -50,55 +130,366 @@ func NewConfig(c PluginConfig) (*AzblobConfig, error) {
 		return nil, fmt.Errorf("cannot specify empty string to Azure_Container")
 	}
 
-	urlString := fmt.Sprintf("https://%s.blob.core.windows.net/%s", c.Get("Azure_Storage_Account"), c.Get("Azure_Container"))
+	account := c.Get("Azure_Storage_Account")
+	accessKey := c.Get("Azure_Storage_Access_Key")
+	sas := c.Get("Azure_Storage_SAS")
 
-	var credential azblob.Credential
-	if c.Get("Azure_Storage_SAS") != "" {
-		credential = azblob.NewAnonymousCredential()
-		urlString = fmt.Sprintf("%s?%s", urlString, c.Get("Azure_Storage_SAS"))
+	var URL *url.URL
+	if v := c.Get("Azure_Storage_Connection_String"); v != "" {
+		for _, k := range []string{"Azure_Storage_Account",
+			"Azure_Storage_Access_Key", "Azure_Storage_SAS", "Azure_Endpoint",
+			"Azure_Endpoint_Suffix"} {
+			if c.Get(k) != "" {
+				return nil, fmt.Errorf(
+					"Azure_Storage_Connection_String cannot be used with %s", k)
+			}
+		}
+		cs, err := ParseConnectionString(v)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"invalid Azure_Storage_Connection_String: %v", err)
+		}
+		account, accessKey, sas = cs.AccountName, cs.AccountKey, cs.SAS
+		URL = cs.BlobEndpoint
 	} else {
-		credential, err = azblob.NewSharedKeyCredential(
-			c.Get("Azure_Storage_Account"), c.Get("Azure_Storage_Access_Key"))
+		URL, err = serviceURL(c, account)
+		if err != nil {
+			return nil, err
+		}
+	}
+	URL.Path = strings.TrimSuffix(URL.Path, "/") + "/" + c.Get("Azure_Container")
+
+	var credential azblob.Credential
+	switch v := c.Get("Azure_Auth_Mode"); v {
+	case "", string(SharedKeyAuth):
+		sasFile := c.Get("Azure_Storage_SAS_File")
+		keyFile := c.Get("Azure_Storage_Access_Key_File")
+		// The file would be rotated into a credential of the other kind.
+		if (sasFile != "" || keyFile != "") && (sas != "" || accessKey != "") {
+			return nil, fmt.Errorf(
+				"a secret file cannot be used with an inline key or SAS")
+		}
+
+		if sasFile != "" {
+			cfg.SecretFile = sasFile
+			cfg.Secret, err = ReadSecretFile(sasFile)
+			sas = cfg.Secret
+		} else if keyFile != "" {
+			cfg.SecretFile = keyFile
+			cfg.Secret, err = ReadSecretFile(keyFile)
+			accessKey = cfg.Secret
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid credential: %v", err)
+		}
+
+		if cfg.SecretFile != "" {
+			useSAS, baseURL := sasFile != "", *URL
+			cfg.ContainerURLFromSecret = func(
+				secret string) (azblob.ContainerURL, error) {
+				URL := baseURL
+				var credential azblob.Credential
+				var err error
+				if useSAS {
+					credential, err = sharedKeyCredential(&URL, account, "", secret)
+				} else {
+					credential, err = sharedKeyCredential(&URL, account, secret, "")
+				}
+				if err != nil {
+					return azblob.ContainerURL{}, err
+				}
+
+				p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+				return azblob.NewContainerURL(URL, p), nil
+			}
+		}
+
+		if key := c.Get("Azure_Storage_Access_Key_Secondary"); key != "" {
+			if sas != "" {
+				return nil, fmt.Errorf(
+					"Azure_Storage_Access_Key_Secondary cannot be used with a SAS")
+			}
+
+			secondary, err := sharedKeyCredential(URL, account, key, "")
+			if err != nil {
+				return nil, fmt.Errorf(
+					"invalid Azure_Storage_Access_Key_Secondary: %v", err)
+			}
+			p := azblob.NewPipeline(secondary, azblob.PipelineOptions{})
+			containerURL := azblob.NewContainerURL(*URL, p)
+			cfg.SecondaryContainerURL = &containerURL
+		}
+
+		credential, err = sharedKeyCredential(URL, account, accessKey, sas)
 		if err != nil {
 			return nil, fmt.Errorf("invalid credential: " + err.Error())
 		}
+	case string(ManagedIdentityAuth):
+		cfg.TokenSource = IMDSTokenSource(
+			c.Get("Azure_IMDS_Endpoint"), c.Get("Azure_Client_ID"))
+	case string(ServicePrincipalAuth):
+		cfg.TokenSource, err = servicePrincipalTokenSource(c)
+		if err != nil {
+			return nil, fmt.Errorf("service principal error: %v", err)
+		}
+	case string(WorkloadIdentityAuth):
+		cfg.TokenSource, err = workloadIdentityTokenSource(c)
+		if err != nil {
+			return nil, fmt.Errorf("workload identity error: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid Azure_Auth_Mode: %s", v)
+	}
+	// The token is fetched by the uploader, see TokenRefresher.
+	if cfg.TokenSource != nil {
+		cfg.TokenCredential = azblob.NewTokenCredential("", nil)
+		credential = cfg.TokenCredential
 	}
 
-	URL, _ := url.Parse(urlString)
 	// Create a ContainerURL object that wraps the container URL and a request
 	// pipeline to make requests.
 	p := azblob.NewPipeline(credential, azblob.PipelineOptions{})
 	cfg.ContainerURL = azblob.NewContainerURL(*URL, p)
 
+	secretRefresh := c.Get("Secret_Refresh_Interval")
+	if secretRefresh != "" {
+		secretRefreshValue, err := strconv.Atoi(secretRefresh)
+		if err != nil || secretRefreshValue <= 0 {
+			return nil, fmt.Errorf(
+				"invalid Secret_Refresh_Interval: %s", secretRefresh)
+		}
+
+		cfg.SecretRefresh = time.Duration(secretRefreshValue) * time.Second
+	} else {
+		cfg.SecretRefresh = DefaultSecretRefresh
+	}
+
 	cfg.AutoCreateContainer, err = strconv.ParseBool(
 		c.Get("Auto_Create_Container"))
 	if err != nil {
 		cfg.AutoCreateContainer = false
 	}
 
-	switch c.Get("StoreAs") {
+	storeAs := c.Get("Store_As")
+	if storeAs == "" {
+		storeAs = c.Get("StoreAs")
+	}
+	switch storeAs {
 	case "text":
 		cfg.StoreAs = PlainTextFormat
+	case "zstd":
+		cfg.StoreAs = ZstdFormat
+		cfg.CompressionLevel = DefaultZstdLevel
+	case "parquet":
+		cfg.StoreAs = ParquetFormat
+	case "avro":
+		cfg.StoreAs = AvroFormat
+	case "csv":
+		cfg.StoreAs = CSVFormat
+	case "tsv":
+		cfg.StoreAs = TSVFormat
+	case "msgpack":
+		cfg.StoreAs = MsgpackFormat
 	default:
 		cfg.StoreAs = GzipFormat
+		cfg.CompressionLevel = gzip.DefaultCompression
+	}
+
+	// Parquet and Avro files are compressed by their own codecs, and the
+	// other formats are not compressed.
+	if v := c.Get("Compression_Level"); v != "" &&
+		cfg.StoreAs != GzipFormat && cfg.StoreAs != ZstdFormat {
+		return nil, fmt.Errorf(
+			"Compression_Level requires Store_As gzip or zstd: %s", storeAs)
+	} else if v != "" {
+		maxLevel := gzip.BestCompression
+		if cfg.StoreAs == ZstdFormat {
+			maxLevel = MaxZstdLevel
+		}
+
+		level, err := strconv.Atoi(v)
+		if err != nil || level < 1 || level > maxLevel {
+			return nil, fmt.Errorf("invalid Compression_Level: %s", v)
+		}
+		cfg.CompressionLevel = level
+	}
+
+	switch v := c.Get("Blob_Type"); v {
+	case "", string(BlockBlobType):
+		cfg.BlobType = BlockBlobType
+	case string(AppendBlobType):
+		cfg.BlobType = AppendBlobType
+	case string(StagedBlobType):
+		cfg.BlobType = StagedBlobType
+	default:
+		return nil, fmt.Errorf("invalid Blob_Type: %s", v)
+	}
+
+	if cfg.StoreAs == ParquetFormat {
+		// A Parquet file cannot be appended to.
+		if cfg.BlobType != BlockBlobType {
+			return nil, fmt.Errorf("Store_As parquet requires Blob_Type block")
+		}
+
+		switch v := c.Get("Parquet_Compression"); v {
+		case "", "snappy":
+			cfg.ParquetCodec = parquet.CompressionCodec_SNAPPY
+		case "gzip":
+			cfg.ParquetCodec = parquet.CompressionCodec_GZIP
+		case "zstd":
+			cfg.ParquetCodec = parquet.CompressionCodec_ZSTD
+		case "none":
+			cfg.ParquetCodec = parquet.CompressionCodec_UNCOMPRESSED
+		default:
+			return nil, fmt.Errorf("invalid Parquet_Compression: %s", v)
+		}
+
+		if v := c.Get("Parquet_Schema_File"); v != "" {
+			cfg.ParquetSchema, err = LoadParquetSchema(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Parquet_Schema_File: %v", err)
+			}
+		}
+	}
+
+	if cfg.StoreAs == AvroFormat {
+		// An object container file cannot be appended to.
+		if cfg.BlobType != BlockBlobType {
+			return nil, fmt.Errorf("Store_As avro requires Blob_Type block")
+		}
+
+		switch v := c.Get("Avro_Compression"); v {
+		case "":
+			cfg.AvroCompression = goavro.CompressionDeflateLabel
+		case goavro.CompressionDeflateLabel, goavro.CompressionSnappyLabel,
+			goavro.CompressionNullLabel:
+			cfg.AvroCompression = v
+		default:
+			return nil, fmt.Errorf("invalid Avro_Compression: %s", v)
+		}
+
+		if v := c.Get("Avro_Schema_File"); v != "" {
+			cfg.AvroSchema, err = LoadAvroSchema(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Avro_Schema_File: %v", err)
+			}
+		}
+	}
+
+	if cfg.StoreAs == CSVFormat || cfg.StoreAs == TSVFormat {
+		cfg.Columns, err = parseColumns(c.Get("Columns"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Columns: %v", err)
+		}
+
+		if v := c.Get("Header_Row"); v != "" {
+			cfg.HeaderRow, err = strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid Header_Row: %v", err)
+			}
+		}
+		// Batches appended to a blob would repeat the header.
+		if cfg.HeaderRow && cfg.BlobType != BlockBlobType {
+			return nil, fmt.Errorf("Header_Row requires Blob_Type block")
+		}
+
+		switch v := c.Get("Nested_Values"); v {
+		case "", string(NestedJSON):
+			cfg.NestedValues = NestedJSON
+		case string(NestedDrop):
+			cfg.NestedValues = NestedDrop
+		default:
+			return nil, fmt.Errorf("invalid Nested_Values: %s", v)
+		}
+	}
+
+	if v := c.Get("Format_Template"); v != "" {
+		switch cfg.StoreAs {
+		case PlainTextFormat, GzipFormat, ZstdFormat:
+		default:
+			return nil, fmt.Errorf(
+				"Format_Template cannot be used with Store_As %s", cfg.StoreAs)
+		}
+
+		cfg.FormatTemplate, err = parseFormatTemplate(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Format_Template: %v", err)
+		}
+	}
+
+	maxBlobSize := c.Get("Max_Blob_Size")
+	if maxBlobSize != "" {
+		cfg.MaxBlobSize, err = bytefmt.ToBytes(maxBlobSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Max_Blob_Size: %v", err)
+		}
 	}
 
-	switch v := c.Get("Azure_Object_Key_Format"); {
+	switch v := c.Get("Time_Slice_Format"); {
 	case v == "":
-		cfg.ObjectKeyFormat = DefaultObjectKeyFormat
+		cfg.TimeSliceFormat = DefaultTimeSliceFormat
+	default:
+		cfg.TimeSliceFormat = v
+	}
+
+	switch v := c.Get("Key_Layout"); v {
+	case "", string(FlatKeyLayout):
+		cfg.KeyLayout = FlatKeyLayout
+
+		switch v := c.Get("Azure_Object_Key_Format"); {
+		case v == "":
+			cfg.ObjectKeyFormat = DefaultObjectKeyFormat
+		default:
+			cfg.ObjectKeyFormat = v
+		}
+	case string(HiveKeyLayout):
+		cfg.KeyLayout = HiveKeyLayout
+
+		// Azure_Object_Key_Format names the blobs in the partitions.
+		cfg.ObjectKeyFormat, err = hiveKeyFormat(c.Get("Key_Partitions"),
+			c.Get("Azure_Object_Key_Format"), cfg.TimeSliceFormat)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Key_Partitions: %v", err)
+		}
 	default:
-		cfg.ObjectKeyFormat = v
+		return nil, fmt.Errorf("invalid Key_Layout: %s", v)
 	}
 	cfg.ObjectKeyFormat = strings.ReplaceAll(
 		cfg.ObjectKeyFormat, "%{path}", c.Get("Path"))
 	cfg.ObjectKeyFormat = strings.ReplaceAll(
 		cfg.ObjectKeyFormat, "%{file_extension}", string(cfg.StoreAs))
 
-	switch v := c.Get("Time_Slice_Format"); {
+	cfg.Hostname = c.Get("Hostname_Override")
+	if cfg.Hostname == "" {
+		cfg.Hostname = Hostname
+	}
+	cfg.ObjectKeyFormat = strings.ReplaceAll(
+		cfg.ObjectKeyFormat, "%{hostname}", cfg.Hostname)
+
+	cfg.ObjectKeyFormat, err = renderEnv(cfg.ObjectKeyFormat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure_Object_Key_Format: %v", err)
+	}
+
+	// A blob of the other types holds many batches.
+	if strings.Contains(cfg.ObjectKeyFormat, "%{sha256") &&
+		cfg.BlobType != BlockBlobType {
+		return nil, fmt.Errorf(
+			"%%{sha256} and %%{sha256_short} require Blob_Type block")
+	}
+
+	cfg.KeyFields, err = parseKeyFields(cfg.ObjectKeyFormat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Azure_Object_Key_Format: %v", err)
+	}
+
+	switch v := c.Get("Object_Key_Fallback"); {
 	case v == "":
-		cfg.TimeSliceFormat = DefaultTimeSliceFormat
+		cfg.KeyFallback = DefaultKeyFallback
+	case sanitizeKeyField(v) != v:
+		return nil, fmt.Errorf("invalid Object_Key_Fallback: %s", v)
 	default:
-		cfg.TimeSliceFormat = v
+		cfg.KeyFallback = v
 	}
 
 	batchWait := c.Get("Batch_Wait")
@@ -131,6 +522,36 @@ func NewConfig(c PluginConfig) (*AzblobConfig, error) {
 		cfg.BatchRetryLimit = &batchRetryLimit
 	}
 
+	cfg.BufferPath = c.Get("Buffer_Path")
+
+	bufferRetry := c.Get("Buffer_Retry_Interval")
+	if bufferRetry != "" {
+		bufferRetryValue, err := strconv.Atoi(bufferRetry)
+		if err != nil || bufferRetryValue < 1 {
+			return nil, fmt.Errorf(
+				"invalid Buffer_Retry_Interval: %s", bufferRetry)
+		}
+
+		cfg.BufferRetry = time.Duration(bufferRetryValue) * time.Second
+	} else {
+		cfg.BufferRetry = DefaultBufferRetry
+	}
+
+	switch v := c.Get("Delivery_Mode"); v {
+	case "", string(AsyncDelivery):
+		cfg.DeliveryMode = AsyncDelivery
+	case string(SyncDelivery):
+		cfg.DeliveryMode = SyncDelivery
+	default:
+		return nil, fmt.Errorf("invalid Delivery_Mode: %s", v)
+	}
+
+	// A sync flush blocks until its upload gives up, which must happen.
+	if cfg.DeliveryMode == SyncDelivery && cfg.BatchRetryLimit == nil {
+		limit := uint64(DefaultSyncRetryLimit)
+		cfg.BatchRetryLimit = &limit
+	}
+
 	cfg.Location, err = time.LoadLocation(c.Get("TimeZone"))
 	if err != nil {
 		return nil, fmt.Errorf("invalid Time_Zone: %v", err)
@@ -147,3 +568,96 @@ func NewConfig(c PluginConfig) (*AzblobConfig, error) {
 
 	return cfg, nil
 }
+
+// sharedKeyCredential returns the credential of a shared key, or adds the
+// SAS to URL if one is given.
+func sharedKeyCredential(
+	URL *url.URL, account, key, sas string) (azblob.Credential, error) {
+	if sas != "" {
+		URL.RawQuery = strings.TrimPrefix(sas, "?")
+		return azblob.NewAnonymousCredential(), nil
+	}
+
+	return azblob.NewSharedKeyCredential(account, key)
+}
+
+func servicePrincipalTokenSource(c PluginConfig) (TokenSource, error) {
+	tenantID, clientID := c.Get("Azure_Tenant_ID"), c.Get("Azure_Client_ID")
+	if tenantID == "" || clientID == "" {
+		return nil, fmt.Errorf("Azure_Tenant_ID and Azure_Client_ID are required")
+	}
+
+	authority := c.Get("Azure_Authority_Host")
+
+	var source TokenSource
+	switch {
+	case c.Get("Azure_Client_Secret") != "":
+		source = ClientSecretTokenSource(
+			authority, tenantID, clientID, c.Get("Azure_Client_Secret"))
+	case c.Get("Azure_Client_Certificate_Path") != "":
+		var err error
+		source, err = ClientCertificateTokenSource(authority, tenantID,
+			clientID, c.Get("Azure_Client_Certificate_Path"))
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf(
+			"Azure_Client_Secret or Azure_Client_Certificate_Path is required")
+	}
+
+	return source, nil
+}
+
+// workloadIdentityTokenSource falls back to the environment variables set by
+// the AKS workload identity webhook for the options which are not given.
+func workloadIdentityTokenSource(c PluginConfig) (TokenSource, error) {
+	tenantID := getOrEnv(c, "Azure_Tenant_ID", "AZURE_TENANT_ID")
+	clientID := getOrEnv(c, "Azure_Client_ID", "AZURE_CLIENT_ID")
+	if tenantID == "" || clientID == "" {
+		return nil, fmt.Errorf("Azure_Tenant_ID and Azure_Client_ID are required")
+	}
+
+	path := getOrEnv(c, "Azure_Federated_Token_File", "AZURE_FEDERATED_TOKEN_FILE")
+	if path == "" {
+		return nil, fmt.Errorf("Azure_Federated_Token_File is required")
+	}
+
+	return FederatedTokenSource(
+		getOrEnv(c, "Azure_Authority_Host", "AZURE_AUTHORITY_HOST"),
+		tenantID, clientID, path), nil
+}
+
+func getOrEnv(c PluginConfig, key, env string) string {
+	if v := c.Get(key); v != "" {
+		return v
+	}
+
+	return os.Getenv(env)
+}
+
+// serviceURL returns the blob service endpoint of the storage account. With
+// path-style addressing, as used by Azurite and Azure Stack, the account name
+// is the first segment of the path instead of part of the host name.
+func serviceURL(c PluginConfig, account string) (*url.URL, error) {
+	endpoint := c.Get("Azure_Endpoint")
+	if endpoint == "" {
+		suffix := c.Get("Azure_Endpoint_Suffix")
+		if suffix == "" {
+			suffix = DefaultEndpointSuffix
+		}
+		endpoint = fmt.Sprintf("https://%s.blob.%s", account, suffix)
+	}
+
+	URL, err := url.Parse(endpoint)
+	if err != nil || URL.Scheme == "" || URL.Host == "" {
+		return nil, fmt.Errorf("invalid Azure_Endpoint: %s", endpoint)
+	}
+
+	pathStyle, err := strconv.ParseBool(c.Get("Azure_Path_Style"))
+	if err == nil && pathStyle {
+		URL.Path = strings.TrimSuffix(URL.Path, "/") + "/" + account
+	}
+
+	return URL, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Well-known account of the storage emulator (Azurite).
+const (
+	DevStoreAccountName = "devstoreaccount1"
+	DevStoreAccountKey  = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	DevStoreBlobPort    = "10000"
+)
+
+// ConnectionString holds the blob service settings of a storage account
+// connection string.
+type ConnectionString struct {
+	AccountName  string
+	AccountKey   string
+	SAS          string
+	BlobEndpoint *url.URL
+}
+
+// ParseConnectionString parses a connection string in the format of the
+// Azure portal, e.g.
+// DefaultEndpointsProtocol=https;AccountName=...;AccountKey=...;EndpointSuffix=core.windows.net
+// Settings of other services, like TableEndpoint, are ignored.
+func ParseConnectionString(s string) (*ConnectionString, error) {
+	settings := map[string]string{}
+	for _, segment := range strings.Split(s, ";") {
+		segment = strings.TrimSpace(segment)
+		if segment == "" {
+			continue
+		}
+
+		i := strings.Index(segment, "=")
+		if i <= 0 {
+			// only print the key, the segment may hold a secret
+			key := segment
+			if i == 0 {
+				key = "<empty>"
+			} else if len(key) > 32 {
+				key = key[:32] + "..."
+			}
+			return nil, fmt.Errorf("malformed setting %q, expected key=value", key)
+		}
+
+		key, value := segment[:i], segment[i+1:]
+		if _, ok := settings[key]; ok {
+			return nil, fmt.Errorf("duplicated setting %s", key)
+		}
+		settings[key] = value
+	}
+
+	if len(settings) == 0 {
+		return nil, fmt.Errorf("empty connection string")
+	}
+
+	if v, ok := settings["UseDevelopmentStorage"]; ok {
+		if !strings.EqualFold(v, "true") {
+			return nil, fmt.Errorf("invalid UseDevelopmentStorage: %s", v)
+		}
+		return devStoreConnectionString(settings["DevelopmentStorageProxyUri"])
+	}
+
+	cs := &ConnectionString{
+		AccountName: settings["AccountName"],
+		AccountKey:  settings["AccountKey"],
+		SAS:         strings.TrimPrefix(settings["SharedAccessSignature"], "?"),
+	}
+
+	if cs.AccountKey != "" && cs.SAS != "" {
+		return nil, fmt.Errorf(
+			"AccountKey and SharedAccessSignature cannot be used together")
+	}
+	if cs.AccountKey == "" && cs.SAS == "" {
+		return nil, fmt.Errorf("AccountKey or SharedAccessSignature is required")
+	}
+	if cs.AccountKey != "" && cs.AccountName == "" {
+		return nil, fmt.Errorf("AccountName is required with AccountKey")
+	}
+
+	if v, ok := settings["BlobEndpoint"]; ok {
+		endpoint, err := url.Parse(v)
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid BlobEndpoint: %s", v)
+		}
+		cs.BlobEndpoint = endpoint
+		return cs, nil
+	}
+
+	if cs.AccountName == "" {
+		return nil, fmt.Errorf("AccountName or BlobEndpoint is required")
+	}
+
+	protocol := settings["DefaultEndpointsProtocol"]
+	switch protocol {
+	case "":
+		protocol = "https"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("invalid DefaultEndpointsProtocol: %s", protocol)
+	}
+
+	suffix := settings["EndpointSuffix"]
+	if suffix == "" {
+		suffix = DefaultEndpointSuffix
+	}
+
+	cs.BlobEndpoint = &url.URL{
+		Scheme: protocol,
+		Host:   fmt.Sprintf("%s.blob.%s", cs.AccountName, suffix),
+	}
+
+	return cs, nil
+}
+
+func devStoreConnectionString(proxy string) (*ConnectionString, error) {
+	endpoint := &url.URL{Scheme: "http", Host: "127.0.0.1"}
+	if proxy != "" {
+		var err error
+		endpoint, err = url.Parse(proxy)
+		if err != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			return nil, fmt.Errorf("invalid DevelopmentStorageProxyUri: %s", proxy)
+		}
+	}
+	endpoint.Host = endpoint.Hostname() + ":" + DevStoreBlobPort
+	endpoint.Path = "/" + DevStoreAccountName
+
+	return &ConnectionString{
+		AccountName:  DevStoreAccountName,
+		AccountKey:   DevStoreAccountKey,
+		BlobEndpoint: endpoint,
+	}, nil
+}
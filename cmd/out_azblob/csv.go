@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+type NestedValues string
+
+const (
+	NestedJSON NestedValues = "json"
+	NestedDrop NestedValues = "drop"
+)
+
+// Column is a column of the CSV and TSV formats.
+type Column struct {
+	Name     string
+	Accessor *RecordAccessor
+}
+
+// parseColumns parses a comma-separated list of record accessors, each
+// optionally prefixed by the name of its column, e.g. pod=$kubernetes['pod'].
+// The name defaults to the last key of the accessor.
+func parseColumns(columns string) ([]Column, error) {
+	var result []Column
+	for _, c := range splitColumns(columns) {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		name, pattern := "", c
+		if i := strings.Index(c, "=$"); i >= 0 {
+			name, pattern = strings.TrimSpace(c[:i]), c[i+1:]
+		}
+
+		ra, err := NewRecordAccessor(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			name = fmt.Sprint(ra.path[len(ra.path)-1])
+		}
+		result = append(result, Column{Name: name, Accessor: ra})
+	}
+
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no columns")
+	}
+
+	return result, nil
+}
+
+// splitColumns splits at the commas outside the subscripts of accessors.
+func splitColumns(s string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, r := range s {
+		switch r {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// createRow encodes the columns of a record as a line of the Store_As format.
+// Maps and arrays are encoded as JSON or left empty, by Nested_Values.
+func createRow(record map[interface{}]interface{}, c *AzblobConfig) ([]byte, error) {
+	values := make([]string, len(c.Columns))
+	for i, column := range c.Columns {
+		v, ok := column.Accessor.Get(record)
+		if !ok {
+			continue
+		}
+
+		switch t := v.(type) {
+		case nil:
+		case string:
+			values[i] = t
+		case []byte:
+			values[i] = string(t)
+		case map[interface{}]interface{}, []interface{}:
+			if c.NestedValues == NestedDrop {
+				continue
+			}
+			js, err := jsoniter.Marshal(jsonValue(t))
+			if err != nil {
+				return nil, err
+			}
+			values[i] = string(js)
+		default:
+			values[i] = fmt.Sprint(t)
+		}
+	}
+
+	return encodeRow(values, c.StoreAs)
+}
+
+func createHeader(c *AzblobConfig) ([]byte, error) {
+	names := make([]string, len(c.Columns))
+	for i, column := range c.Columns {
+		names[i] = column.Name
+	}
+
+	return encodeRow(names, c.StoreAs)
+}
+
+// encodeRow quotes the values which contain the delimiter, quotes or line
+// breaks.
+func encodeRow(values []string, format FileFormat) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if format == TSVFormat {
+		w.Comma = '\t'
+	}
+	if err := w.Write(values); err != nil {
+		return nil, err
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// jsonValue converts the maps of msgpack and bytes to values which encode
+// to JSON objects and strings.
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case []byte:
+		return string(t)
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			m[fmt.Sprint(k)] = jsonValue(v)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, v := range t {
+			l[i] = jsonValue(v)
+		}
+		return l
+	}
+
+	return v
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const IndexCounterTTL = time.Hour
+
+var placeholderPattern = regexp.MustCompile(`%\{[a-z0-9_]+\}`)
+
+// IndexCounter hands out the %{index} of the blobs of an object key.
+type IndexCounter struct {
+	mu       sync.Mutex
+	next     int
+	seeded   bool
+	lastUsed time.Time
+}
+
+// indexCounter returns the counter of an object key, and forgets the counters
+// which have not been used for a while. They are seeded again when needed.
+func (u *AzblobUploader) indexCounter(key string) *IndexCounter {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	for k, c := range u.indexCounters {
+		if now.Sub(c.lastUsed) > IndexCounterTTL {
+			delete(u.indexCounters, k)
+		}
+	}
+
+	c, ok := u.indexCounters[key]
+	if !ok {
+		c = &IndexCounter{}
+		u.indexCounters[key] = c
+	}
+	c.lastUsed = now
+
+	return c
+}
+
+// nextIndex returns the next index of an object key. The counter starts after
+// the highest index found in the container, so that a restart does not reuse
+// the names of the blobs written by the previous run.
+func (u *AzblobUploader) nextIndex(ctx context.Context, key string) (int, error) {
+	c := u.indexCounter(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.seeded {
+		next, err := u.seedIndex(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		c.next, c.seeded = next, true
+	}
+
+	index := c.next
+	c.next++
+
+	return index, nil
+}
+
+// seedIndex lists the blobs under the prefix of key and returns the index
+// following the highest one in use.
+func (u *AzblobUploader) seedIndex(ctx context.Context, key string) (int, error) {
+	i := strings.Index(key, "%{index}")
+	prefix, suffix := key[:i], key[i+len("%{index}"):]
+
+	// Other placeholders of the suffix, like %{uuid}, match anything but a
+	// path separator.
+	parts := placeholderPattern.Split(suffix, -1)
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	pattern, err := regexp.Compile("^" + regexp.QuoteMeta(prefix) +
+		`(\d+)` + strings.Join(parts, `[^/]*`) + "$")
+	if err != nil {
+		return 0, err
+	}
+
+	next := 0
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := u.containerURL().ListBlobsFlatSegment(ctx, marker,
+			azblob.ListBlobsSegmentOptions{Prefix: prefix})
+		if serr, ok := err.(azblob.StorageError); ok &&
+			serr.ServiceCode() == azblob.ServiceCodeContainerNotFound {
+			// The container is created with the first blob.
+			return 0, nil
+		}
+		if err != nil {
+			u.logger.Errorf("list blobs error: %s", err.Error())
+			return 0, err
+		}
+		marker = resp.NextMarker
+
+		for _, blob := range resp.Segment.BlobItems {
+			m := pattern.FindStringSubmatch(blob.Name)
+			if m == nil {
+				continue
+			}
+			if index, err := strconv.Atoi(m[1]); err == nil && index >= next {
+				next = index + 1
+			}
+		}
+	}
+
+	u.logger.Debugf("seed index, prefix=%s next=%d", prefix, next)
+	return next, nil
+}
+
+// uploadIndexed uploads b as the next blob of an object key with %{index}.
+// The index is kept in index across retries, and skipped if another writer
+// took it in the meantime.
+func (u *AzblobUploader) uploadIndexed(key string, b []byte, index *int) error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), Timeout*time.Second)
+	defer cancel()
+
+	for {
+		if *index < 0 {
+			next, err := u.nextIndex(ctx, key)
+			if err != nil {
+				return err
+			}
+			*index = next
+		}
+
+		name := strings.ReplaceAll(key, "%{index}", strconv.Itoa(*index))
+		name = renderUnique(name)
+
+		err := u.uploadBlob(name, b, azblob.BlobAccessConditions{
+			ModifiedAccessConditions: azblob.ModifiedAccessConditions{
+				IfNoneMatch: azblob.ETagAny,
+			},
+		})
+		if serr, ok := err.(azblob.StorageError); ok &&
+			serr.ServiceCode() == azblob.ServiceCodeBlobAlreadyExists {
+			u.logger.Debugf("blob=%s exists, skip index", name)
+			*index = -1
+			continue
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oklog/ulid"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	DefaultHiveFileName = "%{uuid}.%{file_extension}"
+	ShortDigestLength   = 16
+)
+
+var (
+	tagPartPattern = regexp.MustCompile(`%\{tag\[(\d+)\]\}`)
+	envPattern     = regexp.MustCompile(`%\{env:([A-Za-z_][A-Za-z0-9_]*)\}`)
+)
+
+// hiveKeyFormat builds an object key format of Hive-style partition
+// directories, e.g. namespace=default/year=2020/month=10/day=11/hour=04/,
+// followed by fileName. partitions is a comma-separated list of name=source,
+// where source is tag, tag_prefix, tag[N] or a record accessor. A bare tag
+// stands for tag=tag. The time partitions go as deep as timeSliceFormat, as
+// a batch holds the records of a whole time slice.
+func hiveKeyFormat(partitions, fileName, timeSliceFormat string) (string, error) {
+	var b strings.Builder
+	b.WriteString("%{path}")
+
+	for _, p := range strings.Split(partitions, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		name, source := p, p
+		if i := strings.Index(p, "="); i >= 0 {
+			name, source = strings.TrimSpace(p[:i]), strings.TrimSpace(p[i+1:])
+		}
+		if name == "" || sanitizeKeyField(name) != name {
+			return "", fmt.Errorf("invalid partition name %q", name)
+		}
+
+		placeholder := "%{" + source + "}"
+		switch {
+		case source == "tag", source == "tag_prefix",
+			tagPartPattern.FindString(placeholder) == placeholder,
+			strings.HasPrefix(source, "$"):
+		default:
+			return "", fmt.Errorf("invalid partition %s, expected "+
+				"tag, tag_prefix, tag[N] or a record accessor", name)
+		}
+		fmt.Fprintf(&b, "%s=%s/", name, placeholder)
+	}
+
+	b.WriteString(hiveTimePartitions(timeSliceFormat))
+	if fileName == "" {
+		fileName = DefaultHiveFileName
+	}
+	b.WriteString(fileName)
+
+	return b.String(), nil
+}
+
+// hiveTimePartitions returns the time partitions down to the finest unit
+// which timeSliceFormat tells apart.
+func hiveTimePartitions(timeSliceFormat string) string {
+	differs := func(t1, t2 time.Time) bool {
+		return t1.Format(timeSliceFormat) != t2.Format(timeSliceFormat)
+	}
+
+	t := time.Date(2001, 2, 3, 4, 0, 0, 0, time.UTC)
+	switch {
+	case differs(t, t.Add(time.Hour)):
+		return "year=%Y/month=%m/day=%d/hour=%H/"
+	case differs(t, t.AddDate(0, 0, 1)):
+		return "year=%Y/month=%m/day=%d/"
+	case differs(t, t.AddDate(0, 1, 0)):
+		return "year=%Y/month=%m/"
+	}
+
+	return "year=%Y/"
+}
+
+// hasUniqueName reports whether key has a placeholder which is new for
+// every blob.
+func hasUniqueName(key string) bool {
+	return strings.Contains(key, "%{uuid}") || strings.Contains(key, "%{ulid}")
+}
+
+// renderUnique replaces %{uuid} with a random UUID and %{ulid} with a ULID,
+// which sorts by the time it has been generated.
+func renderUnique(key string) string {
+	if strings.Contains(key, "%{uuid}") {
+		key = strings.ReplaceAll(key, "%{uuid}", uuid.NewV4().String())
+	}
+	if strings.Contains(key, "%{ulid}") {
+		id := ulid.MustNew(ulid.Now(), rand.Reader)
+		key = strings.ReplaceAll(key, "%{ulid}", id.String())
+	}
+
+	return key
+}
+
+// renderDigest replaces %{sha256} and %{sha256_short} with the digest of the
+// payload of the blob.
+func renderDigest(key string, payload []byte) string {
+	if !strings.Contains(key, "%{sha256") {
+		return key
+	}
+
+	sum := sha256.Sum256(payload)
+	digest := hex.EncodeToString(sum[:])
+
+	return strings.NewReplacer(
+		"%{sha256}", digest,
+		"%{sha256_short}", digest[:ShortDigestLength],
+	).Replace(key)
+}
+
+// renderEnv replaces the %{env:NAME} placeholders of key with the values of
+// the environment variables.
+func renderEnv(key string) (string, error) {
+	var err error
+	key = envPattern.ReplaceAllStringFunc(key, func(m string) string {
+		name := envPattern.FindStringSubmatch(m)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("environment variable %s is not set", name)
+		}
+
+		return v
+	})
+
+	return key, err
+}
+
+// renderTime replaces the time placeholders of key, %Y, %m, %d, %H, %M and
+// %s (seconds since the epoch), with the components of t.
+func renderTime(key string, t time.Time) string {
+	if !strings.Contains(key, "%") {
+		return key
+	}
+
+	return strings.NewReplacer(
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%H", t.Format("15"),
+		"%M", t.Format("04"),
+		"%s", strconv.FormatInt(t.Unix(), 10),
+	).Replace(key)
+}
+
+// renderTag replaces the tag placeholders of key. %{tag[N]} is the N-th
+// dot-separated part of the tag and %{tag_prefix} the tag without its last
+// part. Parts out of range are rendered as fallback.
+func renderTag(key, tag, fallback string) string {
+	if !strings.Contains(key, "%{tag") {
+		return key
+	}
+
+	parts := strings.Split(tag, ".")
+	key = tagPartPattern.ReplaceAllStringFunc(key, func(m string) string {
+		i, err := strconv.Atoi(tagPartPattern.FindStringSubmatch(m)[1])
+		if err != nil || i >= len(parts) {
+			return fallback
+		}
+
+		return tagValue(parts[i], fallback)
+	})
+
+	prefix := tag
+	if len(parts) > 1 {
+		prefix = strings.Join(parts[:len(parts)-1], ".")
+	}
+	key = strings.ReplaceAll(key, "%{tag_prefix}", tagValue(prefix, fallback))
+
+	return strings.ReplaceAll(key, "%{tag}", tagValue(tag, fallback))
+}
+
+func tagValue(s, fallback string) string {
+	if s = sanitizeKeyField(s); s == "" {
+		return fallback
+	}
+
+	return s
+}
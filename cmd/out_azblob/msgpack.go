@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/ugorji/go/codec"
+)
+
+// EventTime is the timestamp of the events of Fluent Bit, the msgpack
+// extension type 0 of seconds and nanoseconds.
+type EventTime struct {
+	time.Time
+}
+
+func (EventTime) WriteExt(v interface{}) []byte {
+	return eventTimeBytes(v.(*EventTime).Time)
+}
+
+// ReadExt leaves the time zero when the extension is too short to hold the
+// seconds and nanoseconds, as the codec gives no way to fail the event.
+func (EventTime) ReadExt(dst interface{}, src []byte) {
+	t := dst.(*EventTime)
+	if len(src) < 8 {
+		t.Time = time.Time{}
+		return
+	}
+	t.Time = time.Unix(int64(binary.BigEndian.Uint32(src)),
+		int64(binary.BigEndian.Uint32(src[4:])))
+}
+
+var msgpackHandle = newMsgpackHandle()
+
+func newMsgpackHandle() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	if err := h.SetBytesExt(reflect.TypeOf(EventTime{}), 0, EventTime{}); err != nil {
+		panic(err)
+	}
+
+	return h
+}
+
+// EventDecoder reads the events of a Fluent Bit chunk, keeping the msgpack
+// encoding of every event.
+type EventDecoder struct {
+	dec  *codec.Decoder
+	size int
+}
+
+func NewEventDecoder(b []byte) *EventDecoder {
+	// The capacity is cut as the codec may read a truncated value past the
+	// length of the slice.
+	b = b[:len(b):len(b)]
+
+	return &EventDecoder{dec: codec.NewDecoderBytes(b, msgpackHandle), size: len(b)}
+}
+
+// Next returns the next event, or io.EOF at the end of the chunk. A chunk
+// which ends in the middle of an event gives io.ErrUnexpectedEOF.
+func (d *EventDecoder) Next() (event []byte, ts interface{},
+	record map[interface{}]interface{}, err error) {
+	if d.dec.NumBytesRead() >= d.size {
+		return nil, nil, nil, io.EOF
+	}
+
+	var raw codec.Raw
+	if err := d.dec.Decode(&raw); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, nil, nil, err
+	}
+
+	var entry []codec.Raw
+	err = codec.NewDecoderBytes(raw, msgpackHandle).Decode(&entry)
+	if err != nil || len(entry) != 2 {
+		return nil, nil, nil, fmt.Errorf("invalid event, expected [timestamp, record]")
+	}
+	if err := codec.NewDecoderBytes(entry[0], msgpackHandle).Decode(&ts); err != nil {
+		return nil, nil, nil, err
+	}
+	var v interface{}
+	if err := codec.NewDecoderBytes(entry[1], msgpackHandle).Decode(&v); err != nil {
+		return nil, nil, nil, err
+	}
+	record, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("invalid event record %T", v)
+	}
+
+	// Fluent Bit v2 events are [[timestamp, metadata], record]. They are
+	// kept as [timestamp, record], the event of the forward protocol.
+	if header, ok := ts.([]interface{}); ok {
+		var fields []codec.Raw
+		err := codec.NewDecoderBytes(entry[0], msgpackHandle).Decode(&fields)
+		if err != nil || len(header) != 2 {
+			return nil, nil, nil, fmt.Errorf(
+				"invalid event, expected [[timestamp, metadata], record]")
+		}
+		ts = header[0]
+		raw = append(append([]byte{0x92}, fields[0]...), entry[1]...)
+	}
+
+	return raw, ts, record, nil
+}
+
+// createMsgpack encodes a record as an event of Fluent Bit, for the records
+// which do not come with their original encoding.
+func createMsgpack(record map[interface{}]interface{}, ts time.Time) ([]byte, error) {
+	// EventTime would be encoded by the BinaryMarshaler of time.Time.
+	t := codec.RawExt{Tag: 0, Data: eventTimeBytes(ts)}
+
+	var b []byte
+	enc := codec.NewEncoderBytes(&b, msgpackHandle)
+	if err := enc.Encode([]interface{}{t, record}); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func eventTimeBytes(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+
+	return b
+}
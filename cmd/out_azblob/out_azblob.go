@@ -3,6 +3,7 @@ package main
 import (
 	"C"
 	"fmt"
+	"io"
 	"os"
 	"time"
 	"unsafe"
@@ -55,19 +56,56 @@ func NewOperator(id int, cfg *AzblobConfig) (*AzblobOperator, error) {
 	return o, nil
 }
 
-func (o *AzblobOperator) SendRecord(
-	r map[interface{}]interface{}, ts time.Time) error {
-	time.Local = o.config.Location
-	timeSlice := ts.Local().Format(o.config.TimeSliceFormat)
+func (o *AzblobOperator) SendRecord(r map[interface{}]interface{},
+	ts time.Time, tag string, ack *Ack) error {
+	return o.SendEvent(nil, r, ts, tag, ack)
+}
+
+// SendEvent is SendRecord with the msgpack encoding of the event in the
+// chunk, which is stored as is by Store_As msgpack.
+func (o *AzblobOperator) SendEvent(event []byte, r map[interface{}]interface{},
+	ts time.Time, tag string, ack *Ack) error {
+	// The time is converted per operator, as operators may have different
+	// Time_Zone settings.
+	local := ts
+	if o.config.Location != nil {
+		local = ts.In(o.config.Location)
+	}
+	timeSlice := local.Format(o.config.TimeSliceFormat)
 
-	raw, err := createJSON(r)
+	var raw []byte
+	var err error
+	switch {
+	case o.config.StoreAs == MsgpackFormat && event != nil:
+		raw = event
+	case o.config.StoreAs == MsgpackFormat:
+		raw, err = createMsgpack(r, ts)
+	case o.config.StoreAs == AvroFormat && o.config.AvroSchema == nil:
+		raw, err = createAvroEvent(r, ts, tag)
+	case o.config.StoreAs == AvroFormat:
+		raw, err = createAvroRecord(o.config.AvroSchema, r, ts, tag)
+	case o.config.StoreAs == CSVFormat || o.config.StoreAs == TSVFormat:
+		raw, err = createRow(r, o.config)
+	case o.config.FormatTemplate != nil:
+		raw, err = createLine(o.config.FormatTemplate, r, local, tag)
+	default:
+		raw, err = createJSON(r)
+	}
 	if err != nil {
 		return err
 	}
 
-	o.logger.Tracef(
-		"add entry, time_slice=%s raw=%s", timeSlice, raw)
-	o.uploader.Entries <- Entry{TimeSlice: timeSlice, Raw: raw}
+	// Records are batched by the object key rendered with their own fields.
+	key := renderTag(o.config.ObjectKeyFormat, tag, o.config.KeyFallback)
+	key = renderKeyFields(key, o.config.KeyFields, r, o.config.KeyFallback)
+
+	o.logger.Tracef("add entry, tag=%s key=%s time_slice=%s raw=%s",
+		tag, key, timeSlice, raw)
+	if ack != nil {
+		ack.Add()
+	}
+	o.uploader.Entries <- Entry{Tag: tag, Key: key,
+		Time: ts, TimeSlice: timeSlice, Raw: raw, Ack: ack}
 
 	return nil
 }
@@ -132,11 +170,25 @@ func FLBPluginInit(ctx unsafe.Pointer) int {
 
 	operator.logger.Infof("container_url=%v", cfg.ContainerURL)
 	operator.logger.Infof("auto_create_container=%v", cfg.AutoCreateContainer)
+	operator.logger.Infof("key_layout=%s", cfg.KeyLayout)
 	operator.logger.Infof("object_key_format=%s", cfg.ObjectKeyFormat)
+	operator.logger.Infof("hostname=%s", cfg.Hostname)
+	operator.logger.Infof("object_key_fallback=%s", cfg.KeyFallback)
 	operator.logger.Infof("time_slice_format=%s", cfg.TimeSliceFormat)
 	operator.logger.Infof("store_as=%v", cfg.StoreAs)
+	operator.logger.Infof("compression_level=%d", cfg.CompressionLevel)
+	operator.logger.Infof("parquet_compression=%v", cfg.ParquetCodec)
+	operator.logger.Infof("avro_compression=%v", cfg.AvroCompression)
+	operator.logger.Infof("columns=%d", len(cfg.Columns))
+	operator.logger.Infof("header_row=%v", cfg.HeaderRow)
+	operator.logger.Infof("nested_values=%s", cfg.NestedValues)
+	operator.logger.Infof("format_template=%v", cfg.FormatTemplate != nil)
+	operator.logger.Infof("blob_type=%s", cfg.BlobType)
 	operator.logger.Infof("batch_wait=%v", cfg.BatchWait)
 	operator.logger.Infof("batch_limit_size=%s", bytefmt.ByteSize(cfg.BatchLimitSize))
+	operator.logger.Infof("buffer_path=%s", cfg.BufferPath)
+	operator.logger.Infof("buffer_retry_interval=%v", cfg.BufferRetry)
+	operator.logger.Infof("delivery_mode=%s", cfg.DeliveryMode)
 
 	return output.FLB_OK
 }
@@ -149,34 +201,58 @@ func FLBPluginFlush(data unsafe.Pointer, length C.int, tag *C.char) int {
 
 //export FLBPluginFlushCtx
 func FLBPluginFlushCtx(ctx, data unsafe.Pointer, length C.int, tag *C.char) int {
-	var ret int
-	var ts interface{}
-	var record map[interface{}]interface{}
-
 	operator := operators[output.FLBPluginGetContext(ctx).(int)]
-	dec := output.NewDecoder(data, int(length))
+
+	return operator.FlushChunk(C.GoBytes(data, length), C.GoString(tag))
+}
+
+// FlushChunk sends the events of a chunk and returns the status reported to
+// Fluent Bit.
+func (o *AzblobOperator) FlushChunk(data []byte, tag string) int {
+	dec := NewEventDecoder(data)
+
+	// In sync mode the chunk is only acknowledged once its entries are
+	// uploaded, so that Fluent Bit keeps it for retrying on failure.
+	var ack *Ack
+	if o.config.DeliveryMode == SyncDelivery {
+		ack = NewAck()
+	}
 
 	for {
-		ret, ts, record = output.GetRecord(dec)
-		if ret != 0 {
+		event, ts, record, err := dec.Next()
+		if err != nil {
+			if err != io.EOF {
+				o.logger.Warnf("decode event error: %v", err)
+			}
 			break
 		}
 
 		var timestamp time.Time
 		switch t := ts.(type) {
-		case output.FLBTime:
-			timestamp = ts.(output.FLBTime).Time
+		case EventTime:
+			timestamp = t.Time
 		case uint64:
 			timestamp = time.Unix(int64(t), 0)
-		default:
-			operator.logger.Warn(
+		}
+		if timestamp.IsZero() {
+			o.logger.Warn(
 				"timestamp isn't known format. Use current time")
 			timestamp = time.Now()
 		}
 
-		err := operator.SendRecord(record, timestamp)
+		// A record which cannot be rendered would fail every retry of the
+		// chunk, so it is skipped.
+		err = o.SendEvent(event, record, timestamp, tag, ack)
 		if err != nil {
-			operator.logger.Warnf("sending record error: %v", err)
+			o.logger.Warnf("skip record error, tag=%s: %v", tag, err)
+		}
+	}
+
+	if ack != nil {
+		// Batches of other chunks keep waiting for Batch_Wait.
+		o.uploader.Flush(ack)
+		if err := ack.Wait(); err != nil {
+			o.logger.Warnf("upload chunk error: %v", err)
 
 			return output.FLB_RETRY
 		}
@@ -4,18 +4,43 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/fluent/fluent-bit-go/output"
 	"github.com/joho/godotenv"
+	"github.com/klauspost/compress/zstd"
+	"github.com/linkedin/goavro/v2"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
 )
 
 var testConf = map[string]string{
@@ -60,6 +85,571 @@ func TestNewConfig(t *testing.T) {
 	assert.True(t, strings.Contains(cfg.ContainerURL.String(), "fluentSAS"))
 }
 
+type mapConfig map[string]string
+
+func (mc mapConfig) Get(key string) string {
+	return mc[key]
+}
+
+// assertConfigErrors asserts that NewConfig fails for each of the cases,
+// which are added to the base options and a valid container and SAS.
+func assertConfigErrors(t *testing.T, base mapConfig, cases []mapConfig) {
+	t.Helper()
+	for _, c := range cases {
+		mc := mapConfig{
+			"Azure_Container":       "testContainer",
+			"Azure_Storage_Account": "testAccount",
+			"Azure_Storage_SAS":     "fluentSAS",
+		}
+		for k, v := range base {
+			mc[k] = v
+		}
+		for k, v := range c {
+			mc[k] = v
+		}
+		_, err := NewConfig(mc)
+		assert.NotNil(t, err, c)
+	}
+}
+
+func TestNewConfigEndpoint(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "?sv=2019-12-12&sig=fluentSAS",
+		"Azure_Endpoint_Suffix": "core.chinacloudapi.cn",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t,
+		"https://testAccount.blob.core.chinacloudapi.cn/testContainer?sv=2019-12-12&sig=fluentSAS",
+		cfg.ContainerURL.String())
+
+	cfg, err = NewConfig(mapConfig{
+		"Azure_Container":          "testContainer",
+		"Azure_Storage_Account":    "devstoreaccount1",
+		"Azure_Storage_Access_Key": "dGVzYWNjZXNzdGtleQo=",
+		"Azure_Endpoint":           "http://127.0.0.1:10000",
+		"Azure_Path_Style":         "true",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t,
+		"http://127.0.0.1:10000/devstoreaccount1/testContainer",
+		cfg.ContainerURL.String())
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container": "testContainer",
+		"Azure_Endpoint":  "127.0.0.1:10000",
+	})
+	assert.Error(t, err)
+}
+
+func TestParseConnectionString(t *testing.T) {
+	cs, err := ParseConnectionString(
+		"DefaultEndpointsProtocol=https;AccountName=testAccount;" +
+			"AccountKey=dGVzYWNjZXNzdGtleQo=;EndpointSuffix=core.usgovcloudapi.net")
+	assert.Nil(t, err)
+	assert.Equal(t, "testAccount", cs.AccountName)
+	assert.Equal(t, "dGVzYWNjZXNzdGtleQo=", cs.AccountKey)
+	assert.Equal(t, "https://testAccount.blob.core.usgovcloudapi.net",
+		cs.BlobEndpoint.String())
+
+	cs, err = ParseConnectionString(
+		"BlobEndpoint=https://testAccount.privatelink.blob.core.windows.net;" +
+			"SharedAccessSignature=sv=2019-12-12&sig=fluentSAS")
+	assert.Nil(t, err)
+	assert.Equal(t, "sv=2019-12-12&sig=fluentSAS", cs.SAS)
+	assert.Equal(t, "https://testAccount.privatelink.blob.core.windows.net",
+		cs.BlobEndpoint.String())
+
+	cs, err = ParseConnectionString("UseDevelopmentStorage=true")
+	assert.Nil(t, err)
+	assert.Equal(t, DevStoreAccountName, cs.AccountName)
+	assert.Equal(t, "http://127.0.0.1:10000/devstoreaccount1",
+		cs.BlobEndpoint.String())
+
+	for _, s := range []string{
+		"",
+		"AccountName=testAccount;AccountKey",
+		"AccountKey=dGVzYWNjZXNzdGtleQo=",
+		"AccountName=testAccount;AccountKey=a2V5;DefaultEndpointsProtocol=ftp",
+		"AccountName=a;AccountName=b",
+		"BlobEndpoint=127.0.0.1:10000;SharedAccessSignature=sig=fluentSAS",
+		"AccountName=testAccount",
+		"BlobEndpoint=https://testAccount.blob.core.windows.net",
+	} {
+		_, err = ParseConnectionString(s)
+		assert.Error(t, err, s)
+	}
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":                 "testContainer",
+		"Azure_Storage_Connection_String": "UseDevelopmentStorage=true",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "http://127.0.0.1:10000/devstoreaccount1/testContainer",
+		cfg.ContainerURL.String())
+
+	assertConfigErrors(t, mapConfig{
+		"Azure_Storage_Connection_String": "UseDevelopmentStorage=true",
+	}, []mapConfig{
+		{},
+		{"Azure_Storage_Account": "", "Azure_Endpoint": "http://127.0.0.1:10000"},
+		{"Azure_Storage_SAS": "", "Azure_Storage_Access_Key": "a2V5"},
+	})
+}
+
+func TestSecretFile(t *testing.T) {
+	sasFile := filepath.Join(t.TempDir(), "sas")
+	ioutil.WriteFile(sasFile, []byte("sv=2019-12-12&se=2020-10-11T00:00:00Z&sig=first\n"), 0600)
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":         "testContainer",
+		"Azure_Storage_Account":   "testAccount",
+		"Azure_Storage_SAS_File":  sasFile,
+		"Secret_Refresh_Interval": "1",
+	})
+	assert.Nil(t, err)
+	assert.Contains(t, cfg.ContainerURL.String(), "sig=first")
+	// the watcher starts from the secret read by the config
+	assert.Equal(t, "sv=2019-12-12&se=2020-10-11T00:00:00Z&sig=first", cfg.Secret)
+
+	expiry, ok := sasExpiry(cfg.ContainerURL.URL().RawQuery)
+	assert.True(t, ok)
+	assert.Equal(t, time.Date(2020, 10, 11, 0, 0, 0, 0, time.UTC), expiry)
+
+	for _, inline := range []string{"Azure_Storage_SAS", "Azure_Storage_Access_Key"} {
+		_, err := NewConfig(mapConfig{
+			"Azure_Container":               "testContainer",
+			"Azure_Storage_Account":         "testAccount",
+			"Azure_Storage_Access_Key_File": sasFile,
+			inline:                          "c2Vjb25kYXJ5",
+		})
+		assert.Error(t, err, inline)
+	}
+
+	container, err := cfg.ContainerURLFromSecret("sv=2019-12-12&sig=second")
+	assert.Nil(t, err)
+	assert.Contains(t, container.String(), "sig=second")
+	assert.NotContains(t, container.String(), "sig=first")
+
+	rotated := make(chan string, 1)
+	w := NewSecretWatcher(sasFile, 10*time.Millisecond,
+		"sv=2019-12-12&se=2020-10-11T00:00:00Z&sig=first",
+		func(secret string) error {
+			rotated <- secret
+			return nil
+		})
+	defer w.Stop()
+
+	ioutil.WriteFile(sasFile, []byte("sv=2019-12-12&sig=second"), 0600)
+	select {
+	case secret := <-rotated:
+		assert.Equal(t, "sv=2019-12-12&sig=second", secret)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "secret rotation not detected")
+	}
+}
+
+func TestSecondaryAccessKey(t *testing.T) {
+	_, err := NewConfig(mapConfig{
+		"Azure_Container":                    "testContainer",
+		"Azure_Storage_Account":              "testAccount",
+		"Azure_Storage_SAS":                  "fluentSAS",
+		"Azure_Storage_Access_Key_Secondary": "c2Vjb25kYXJ5",
+	})
+	assert.NotNil(t, err)
+
+	var primary, secondary int32
+	newContainer := func(count *int32, status int) azblob.ContainerURL {
+		ts := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(count, 1)
+				if status == http.StatusForbidden {
+					w.Header().Set("x-ms-error-code", "AuthenticationFailed")
+				}
+				w.WriteHeader(status)
+			}))
+		t.Cleanup(ts.Close)
+
+		URL, _ := url.Parse(ts.URL + "/testContainer")
+		p := azblob.NewPipeline(azblob.NewAnonymousCredential(),
+			azblob.PipelineOptions{})
+		return azblob.NewContainerURL(*URL, p)
+	}
+
+	u := &AzblobUploader{
+		containers: []azblob.ContainerURL{
+			newContainer(&primary, http.StatusForbidden),
+			newContainer(&secondary, http.StatusOK),
+		},
+		logger: NewLogger("testing", logrus.TraceLevel),
+	}
+
+	getProperties := func() error {
+		_, err := u.containerURL().GetProperties(
+			context.Background(), azblob.LeaseAccessConditions{})
+		return err
+	}
+
+	assert.Nil(t, u.withFailover(getProperties))
+	assert.Equal(t, 1, u.active)
+
+	// the working key is remembered
+	assert.Nil(t, u.withFailover(getProperties))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&primary))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&secondary))
+}
+
+func TestManagedIdentity(t *testing.T) {
+	var count int32
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "true", r.Header.Get("Metadata"))
+			assert.Equal(t, "client-id", r.URL.Query().Get("client_id"))
+			assert.Equal(t, StorageResource, r.URL.Query().Get("resource"))
+
+			n := atomic.AddInt32(&count, 1)
+			fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":"2"}`, n)
+		}))
+	defer ts.Close()
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Auth_Mode":       "managed_identity",
+		"Azure_Client_ID":       "client-id",
+		"Azure_IMDS_Endpoint":   ts.URL,
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, cfg)
+
+	// no token is fetched before the uploader starts
+	assert.Equal(t, int32(0), atomic.LoadInt32(&count))
+	assert.Equal(t, "", cfg.TokenCredential.Token())
+
+	refresher := NewTokenRefresher(cfg.TokenCredential, cfg.TokenSource,
+		NewLogger("azblob.0", cfg.LogLevel))
+	defer refresher.Stop()
+	credential := cfg.TokenCredential
+	assert.Eventually(t, func() bool {
+		return credential.Token() != ""
+	}, 5*time.Second, 10*time.Millisecond)
+	initial := credential.Token()
+	assert.Regexp(t, "^token-[0-9]+$", initial)
+	assert.Eventually(t, func() bool {
+		return credential.Token() != initial
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// an unreachable endpoint doesn't fail the configuration
+	ts.Close()
+	cfg, err = NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Auth_Mode":       "managed_identity",
+		"Azure_IMDS_Endpoint":   ts.URL,
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, cfg)
+}
+
+func TestServicePrincipal(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	certPath := filepath.Join(t.TempDir(), "client.pem")
+	ioutil.WriteFile(certPath, append(
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{
+			Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})...), 0600)
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/tenant-id/oauth2/v2.0/token", r.URL.Path)
+			assert.Equal(t, "client_credentials", r.FormValue("grant_type"))
+			assert.Equal(t, "client-id", r.FormValue("client_id"))
+			assert.Equal(t, StorageScope, r.FormValue("scope"))
+
+			if r.FormValue("client_secret") == "secret" {
+				fmt.Fprint(w, `{"access_token":"secret-token","expires_in":3599}`)
+				return
+			}
+
+			parts := strings.Split(r.FormValue("client_assertion"), ".")
+			if len(parts) == 3 {
+				signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+				hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+				err := rsa.VerifyPKCS1v15(
+					&key.PublicKey, crypto.SHA256, hash[:], signature)
+				if err == nil {
+					fmt.Fprint(w, `{"access_token":"certificate-token","expires_in":3599}`)
+					return
+				}
+			}
+
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+		}))
+	defer ts.Close()
+
+	source := ClientSecretTokenSource(ts.URL, "tenant-id", "client-id", "secret")
+	token, err := source()
+	assert.Nil(t, err)
+	assert.Equal(t, "secret-token", token.AccessToken)
+
+	source = ClientSecretTokenSource(ts.URL, "tenant-id", "client-id", "wrong")
+	_, err = source()
+	assert.Error(t, err)
+
+	source, err = ClientCertificateTokenSource(ts.URL, "tenant-id", "client-id", certPath)
+	assert.Nil(t, err)
+	token, err = source()
+	assert.Nil(t, err)
+	assert.Equal(t, "certificate-token", token.AccessToken)
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Auth_Mode":       "service_principal",
+		"Azure_Tenant_ID":       "tenant-id",
+		"Azure_Client_ID":       "client-id",
+	})
+	assert.Error(t, err)
+}
+
+func TestWorkloadIdentity(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "azure-identity-token")
+	ioutil.WriteFile(tokenFile, []byte("federated-1\n"), 0600)
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, ClientAssertionType, r.FormValue("client_assertion_type"))
+			fmt.Fprintf(w, `{"access_token":"token-%s","expires_in":3599}`,
+				r.FormValue("client_assertion"))
+		}))
+	defer ts.Close()
+
+	os.Setenv("AZURE_AUTHORITY_HOST", ts.URL)
+	os.Setenv("AZURE_TENANT_ID", "tenant-id")
+	os.Setenv("AZURE_FEDERATED_TOKEN_FILE", tokenFile)
+	defer os.Unsetenv("AZURE_AUTHORITY_HOST")
+	defer os.Unsetenv("AZURE_TENANT_ID")
+	defer os.Unsetenv("AZURE_FEDERATED_TOKEN_FILE")
+
+	source, err := workloadIdentityTokenSource(mapConfig{
+		"Azure_Client_ID": "client-id",
+	})
+	assert.Nil(t, err)
+	token, err := source()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-federated-1", token.AccessToken)
+
+	// the rotated token is used for the next request
+	ioutil.WriteFile(tokenFile, []byte("federated-2"), 0600)
+	source = FederatedTokenSource(ts.URL, "tenant-id", "client-id", tokenFile)
+	token, err = source()
+	assert.Nil(t, err)
+	assert.Equal(t, "token-federated-2", token.AccessToken)
+}
+
+func TestRecordAccessor(t *testing.T) {
+	record := map[interface{}]interface{}{
+		"level": []byte("info"),
+		"kubernetes": map[interface{}]interface{}{
+			"namespace_name": []byte("kube-system"),
+			"labels": map[interface{}]interface{}{
+				"app.kubernetes.io/name": "fluent bit",
+			},
+		},
+		"items": []interface{}{int64(1), "two"},
+	}
+
+	for pattern, expected := range map[string]interface{}{
+		"$level":                        []byte("info"),
+		"$.level":                       []byte("info"),
+		"$kubernetes['namespace_name']": []byte("kube-system"),
+		`$kubernetes["namespace_name"]`: []byte("kube-system"),
+		"$.kubernetes.namespace_name":   []byte("kube-system"),
+		"$items[1]":                     "two",
+		"$kubernetes['labels']['app.kubernetes.io/name']": "fluent bit",
+	} {
+		ra, err := NewRecordAccessor(pattern)
+		assert.Nil(t, err, pattern)
+
+		v, ok := ra.Get(record)
+		assert.True(t, ok, pattern)
+		assert.Equal(t, expected, v, pattern)
+	}
+
+	for _, pattern := range []string{"$missing", "$level[0]", "$items[2]"} {
+		ra, _ := NewRecordAccessor(pattern)
+		_, ok := ra.Get(record)
+		assert.False(t, ok, pattern)
+	}
+
+	for _, pattern := range []string{"level", "$", "$a..b", "$a[", "$a[x]"} {
+		_, err := NewRecordAccessor(pattern)
+		assert.NotNil(t, err, pattern)
+	}
+}
+
+func TestObjectKeyFields(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":         "testContainer",
+		"Azure_Storage_Account":   "testAccount",
+		"Azure_Storage_SAS":       "fluentSAS",
+		"Azure_Object_Key_Format": "%{$kubernetes['namespace_name']}/%{$.level}/%{time_slice}",
+	})
+	assert.Nil(t, err)
+	assert.Len(t, cfg.KeyFields, 2)
+	assert.Equal(t, DefaultKeyFallback, cfg.KeyFallback)
+
+	key := renderKeyFields(cfg.ObjectKeyFormat, cfg.KeyFields,
+		map[interface{}]interface{}{
+			"kubernetes": map[interface{}]interface{}{
+				"namespace_name": []byte("../kube system"),
+			},
+			"level": map[interface{}]interface{}{},
+		}, cfg.KeyFallback)
+	assert.Equal(t, "%2E.%2Fkube system/unknown/%{time_slice}", key)
+
+	// distinct values never share a key
+	for v, expected := range map[string]string{
+		"App": "App", "app": "app", "a/b": "a%2Fb", "a_b": "a_b",
+		"a%2Fb": "a%252Fb", "..": "%2E%2E", "v1.": "v1%2E",
+	} {
+		assert.Equal(t, expected, sanitizeKeyField(v), v)
+	}
+
+	// Long values are cut after escaping, on a character or escape boundary,
+	// and keep a hash of the whole value.
+	long := strings.Repeat("é", 100)
+	sum := sha256.Sum256([]byte(long))
+	assert.Equal(t, strings.Repeat("é", 55)+fmt.Sprintf("%%~%x", sum[:8]),
+		sanitizeKeyField(long))
+	for _, v := range []string{
+		strings.Repeat("/", 200), strings.Repeat("a/", 100), strings.Repeat("ab/", 100),
+	} {
+		s := sanitizeKeyField(v)
+		assert.True(t, len(s) <= MaxKeyFieldLength, s)
+		head := s[:strings.Index(s, "%~")]
+		assert.False(t, strings.HasSuffix(head, "%") || strings.HasSuffix(head, "%2"), s)
+		// values sharing their first bytes
+		assert.NotEqual(t, s, sanitizeKeyField(v+"x"), v)
+	}
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":         "testContainer",
+		"Azure_Storage_Account":   "testAccount",
+		"Azure_Storage_SAS":       "fluentSAS",
+		"Azure_Object_Key_Format": "%{$kubernetes[}/%{uuid}",
+	})
+	assert.NotNil(t, err)
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "fluentSAS",
+		"Object_Key_Fallback":   "a/b",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestRenderTag(t *testing.T) {
+	format := "%{tag_prefix}/%{tag[0]}/%{tag[2]}/%{tag[4]}/%{tag}"
+	assert.Equal(t, "kube.var.log/kube/log/unknown/kube.var.log.app",
+		renderTag(format, "kube.var.log.app", "unknown"))
+	assert.Equal(t, "app/app/unknown/unknown/app",
+		renderTag(format, "app", "unknown"))
+	assert.Equal(t, "%{time_slice}", renderTag("%{time_slice}", "app", "unknown"))
+}
+
+func TestRenderTimeAndEnv(t *testing.T) {
+	ts := time.Date(2020, 10, 11, 4, 5, 6, 0, time.UTC)
+	assert.Equal(t, "2020/10/11/04/05/1602389106.gz",
+		renderTime("%Y/%m/%d/%H/%M/%s.gz", ts))
+
+	os.Setenv("AZBLOB_TEST_CLUSTER", "prod")
+	defer os.Unsetenv("AZBLOB_TEST_CLUSTER")
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":         "testContainer",
+		"Azure_Storage_Account":   "testAccount",
+		"Azure_Storage_SAS":       "fluentSAS",
+		"Hostname_Override":       "node-1",
+		"Azure_Object_Key_Format": "%{env:AZBLOB_TEST_CLUSTER}/%{hostname}/%Y/%{uuid}",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "prod/node-1/%Y/%{uuid}", cfg.ObjectKeyFormat)
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":         "testContainer",
+		"Azure_Storage_Account":   "testAccount",
+		"Azure_Storage_SAS":       "fluentSAS",
+		"Azure_Object_Key_Format": "%{env:AZBLOB_TEST_MISSING}/%{uuid}",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestUniqueAndDigestNames(t *testing.T) {
+	first := renderUnique("%{ulid}")
+	time.Sleep(2 * time.Millisecond)
+	second := renderUnique("%{ulid}")
+	assert.Len(t, first, 26)
+	assert.True(t, first < second)
+	assert.Len(t, renderUnique("%{uuid}"), 36)
+
+	assert.Equal(t,
+		"logs/2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824.gz"+
+			"/2cf24dba5fb0a30e",
+		renderDigest("logs/%{sha256}.gz/%{sha256_short}", []byte("hello")))
+
+	_, err := NewConfig(mapConfig{
+		"Azure_Container":         "testContainer",
+		"Azure_Storage_Account":   "testAccount",
+		"Azure_Storage_SAS":       "fluentSAS",
+		"Blob_Type":               "append",
+		"Azure_Object_Key_Format": "%{sha256}.gz",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestHiveKeyLayout(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "fluentSAS",
+		"Path":                  "logs/",
+		"Key_Layout":            "hive",
+		"Key_Partitions":        "namespace=$kubernetes['namespace_name'], tag",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "logs/namespace=%{$kubernetes['namespace_name']}/tag=%{tag}/"+
+		"year=%Y/month=%m/day=%d/hour=%H/%{uuid}.gz", cfg.ObjectKeyFormat)
+	assert.Len(t, cfg.KeyFields, 1)
+
+	key, err := hiveKeyFormat("app=tag[1]", "%{time_slice}.log", "20060102")
+	assert.Nil(t, err)
+	assert.Equal(t, "%{path}app=%{tag[1]}/"+
+		"year=%Y/month=%m/day=%d/%{time_slice}.log", key)
+
+	// batches never span more than one partition
+	assert.Equal(t, "year=%Y/month=%m/day=%d/hour=%H/",
+		hiveTimePartitions(DefaultTimeSliceFormat))
+	assert.Equal(t, "year=%Y/month=%m/day=%d/hour=%H/",
+		hiveTimePartitions("2006-01-02T3PM"))
+	assert.Equal(t, "year=%Y/month=%m/", hiveTimePartitions("2006-Jan"))
+	assert.Equal(t, "year=%Y/", hiveTimePartitions("static"))
+
+	for _, partitions := range []string{"app=level", "=tag", "a/b=tag"} {
+		_, err := hiveKeyFormat(partitions, "", DefaultTimeSliceFormat)
+		assert.NotNil(t, err, partitions)
+	}
+}
+
 func TestCreateJSON(t *testing.T) {
 	record := make(map[interface{}]interface{})
 	record["key"] = "value"
@@ -150,20 +740,614 @@ func readGzip(dst io.Writer, src io.Reader) error {
 	return nil
 }
 
-func TestMakeGzip(t *testing.T) {
-	var line = "a gzipped string line which is compressed by compress/gzip library written in Go."
+func TestBatchWriter(t *testing.T) {
+	entries := [][]byte{[]byte(`{"key":"value1"}`), []byte(`{"key":"value2"}`)}
+	dec, _ := zstd.NewReader(nil)
+	defer dec.Close()
 
-	compressed, err := makeGzip([]byte(line))
-	if err != nil {
-		assert.Fail(t, "compress string with gzip fails: %v", err)
+	for _, c := range []struct {
+		cfg      *AzblobConfig
+		expected string
+	}{
+		{&AzblobConfig{StoreAs: PlainTextFormat, BlobType: BlockBlobType},
+			"{\"key\":\"value1\"}\n{\"key\":\"value2\"}"},
+		{&AzblobConfig{StoreAs: PlainTextFormat, BlobType: AppendBlobType},
+			"{\"key\":\"value1\"}\n{\"key\":\"value2\"}\n"},
+		{&AzblobConfig{StoreAs: GzipFormat, BlobType: BlockBlobType, CompressionLevel: 9},
+			"{\"key\":\"value1\"}\n{\"key\":\"value2\"}"},
+		{&AzblobConfig{StoreAs: ZstdFormat, BlobType: BlockBlobType, CompressionLevel: 19},
+			"{\"key\":\"value1\"}\n{\"key\":\"value2\"}"},
+	} {
+		w, err := NewBatchWriter(c.cfg)
+		assert.Nil(t, err)
+		for _, raw := range entries {
+			assert.Nil(t, w.Write(raw))
+		}
+		payload, err := w.Close()
+		assert.Nil(t, err)
+
+		var b bytes.Buffer
+		switch c.cfg.StoreAs {
+		case GzipFormat:
+			assert.Nil(t, readGzip(&b, bytes.NewReader(payload)))
+		case ZstdFormat:
+			decoded, err := dec.DecodeAll(payload, nil)
+			assert.Nil(t, err)
+			b.Write(decoded)
+		default:
+			b.Write(payload)
+		}
+		assert.Equal(t, c.expected, b.String(), string(c.cfg.StoreAs))
 	}
 
+	_, err := NewBatchWriter(&AzblobConfig{StoreAs: GzipFormat, CompressionLevel: 42})
+	assert.NotNil(t, err)
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "fluentSAS",
+		"Store_As":              "zstd",
+		"Compression_Level":     "19",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, ZstdFormat, cfg.StoreAs)
+	assert.Equal(t, 19, cfg.CompressionLevel)
+	assert.Equal(t, "zstd", cfg.StoreAs.ContentEncoding())
+	assert.True(t, strings.HasSuffix(cfg.ObjectKeyFormat, ".zst"))
+
+	_, err = NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "fluentSAS",
+		"Compression_Level":     "19",
+	})
+	assert.NotNil(t, err)
+
+	assertConfigErrors(t, mapConfig{"Compression_Level": "1"}, []mapConfig{
+		{"Store_As": "text"},
+		{"Store_As": "parquet"},
+		{"Store_As": "csv"},
+	})
+}
+
+func TestBatchLimitSize(t *testing.T) {
+	uploaded := make(chan []byte, 100)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "PUT" {
+				body, _ := ioutil.ReadAll(r.Body)
+				uploaded <- body
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+	defer ts.Close()
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "sig=fluentSAS",
+		"Azure_Endpoint":        ts.URL,
+		"Batch_Limit_Size":      "1k",
+		"Batch_Wait":            "60",
+	})
+	assert.Nil(t, err)
+
+	// 20k of compressible records stay in one batch, as the limit applies
+	// to their compressed size.
+	o, err := NewOperator(0, cfg)
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, o.SendRecord(map[interface{}]interface{}{
+			"log": fmt.Sprintf("GET /index.html HTTP/1.1 200 %d", i)},
+			time.Now(), "app", nil))
+	}
+	o.uploader.Stop()
+	assert.Equal(t, 1, len(uploaded))
 	var b bytes.Buffer
-	err = readGzip(&b, bytes.NewReader(compressed))
-	if err != nil {
-		assert.Fail(t, "decompress from gzippped string fails: %v", err)
+	assert.Nil(t, readGzip(&b, bytes.NewReader(<-uploaded)))
+	assert.Equal(t, 500, strings.Count(b.String(), "\n")+1)
+
+	// Records which do not compress roll over once the compressed batch
+	// passes the limit.
+	o, err = NewOperator(0, cfg)
+	assert.Nil(t, err)
+	noise := make([]byte, 512)
+	for i := 0; i < 200; i++ {
+		rand.Read(noise)
+		assert.Nil(t, o.SendRecord(map[interface{}]interface{}{
+			"log": hex.EncodeToString(noise)}, time.Now(), "app", nil))
+	}
+	o.uploader.Stop()
+	close(uploaded)
+	var blobs [][]byte
+	for body := range uploaded {
+		blobs = append(blobs, body)
+	}
+	assert.True(t, len(blobs) > 1)
+	for _, body := range blobs[:len(blobs)-1] {
+		assert.True(t, len(body) > 1024, len(body))
+	}
+}
+
+func TestParquetWriter(t *testing.T) {
+	entries := [][]byte{
+		[]byte(`{"log":"line1","code":200,"kubernetes":{"pod":"app-1","labels":{"app":"web"}},"tags":["a","b"]}`),
+		[]byte(`{"log":"line2","code":1.5,"kubernetes":{"pod":"app-2"},"tags":["c",null],"extra":null}`),
+		[]byte(`{"log":{"nested":true},"code":null}`),
+	}
+
+	for _, codec := range []parquet.CompressionCodec{
+		parquet.CompressionCodec_SNAPPY,
+		parquet.CompressionCodec_GZIP,
+		parquet.CompressionCodec_ZSTD,
+	} {
+		w, err := NewBatchWriter(&AzblobConfig{
+			StoreAs: ParquetFormat, BlobType: BlockBlobType, ParquetCodec: codec})
+		assert.Nil(t, err)
+		for _, raw := range entries {
+			assert.Nil(t, w.Write(raw))
+		}
+		assert.True(t, w.Size() > 0)
+
+		payload, err := w.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, "PAR1", string(payload[:4]))
+
+		pf, _ := buffer.NewBufferFile(payload)
+		pr, err := reader.NewParquetReader(pf, nil, 1)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(entries)), pr.GetNumRows())
+		assert.Equal(t, codec,
+			pr.Footer.RowGroups[0].Columns[0].MetaData.Codec, codec.String())
+
+		rows, err := pr.ReadByNumber(len(entries))
+		assert.Nil(t, err)
+		b, _ := json.Marshal(rows)
+		pr.ReadStop()
+		assert.Equal(t, `[{"Code":200,"Kubernetes":{"Labels":{"App":"web"},"Pod":"app-1"},"Log":"line1","Tags":["a","b"]},`+
+			`{"Code":1.5,"Kubernetes":{"Labels":null,"Pod":"app-2"},"Log":"line2","Tags":["c"]},`+
+			`{"Code":null,"Kubernetes":null,"Log":"{\"nested\":true}","Tags":null}]`, string(b))
+	}
+
+	// Samples without a typed value fail neither their own write nor the
+	// last one sampled. The schema is inferred once a record has one.
+	w, err := NewBatchWriter(&AzblobConfig{StoreAs: ParquetFormat, BlobType: BlockBlobType})
+	assert.Nil(t, err)
+	for i := 0; i < ParquetSchemaSample; i++ {
+		raw := `{"log":null}`
+		if i == 10 {
+			raw = `{}`
+		}
+		assert.Nil(t, w.Write([]byte(raw)), i)
+	}
+	assert.Nil(t, w.Write([]byte(`{"log":"line1"}`)))
+	payload, err := w.Close()
+	assert.Nil(t, err)
+	pf, _ := buffer.NewBufferFile(payload)
+	pr, err := reader.NewParquetReader(pf, nil, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(ParquetSchemaSample+1), pr.GetNumRows())
+	pr.ReadStop()
+
+	w, err = NewBatchWriter(&AzblobConfig{StoreAs: ParquetFormat, BlobType: BlockBlobType})
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write([]byte(`{}`)))
+	_, err = w.Close()
+	assert.NotNil(t, err)
+
+	// The fields of a schema file are required as declared.
+	schema := `{"Tag":"name=parquet_go_root, repetitiontype=REQUIRED","Fields":[` +
+		`{"Tag":"name=log, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=REQUIRED"},` +
+		`{"Tag":"name=code, type=INT32, repetitiontype=OPTIONAL"}]}`
+	dir, _ := ioutil.TempDir("", "parquet")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.json")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(schema), 0644))
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "fluentSAS",
+		"Store_As":              "parquet",
+		"Parquet_Compression":   "gzip",
+		"Parquet_Schema_File":   path,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, parquet.CompressionCodec_GZIP, cfg.ParquetCodec)
+	assert.Equal(t, "", cfg.StoreAs.ContentEncoding())
+	assert.True(t, strings.HasSuffix(cfg.ObjectKeyFormat, ".parquet"))
+
+	w, err = NewBatchWriter(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write(entries[0]))
+	assert.NotNil(t, w.Write([]byte(`{"code":1}`)))
+	payload, err = w.Close()
+	assert.Nil(t, err)
+
+	pf, _ = buffer.NewBufferFile(payload)
+	pr, err = reader.NewParquetReader(pf, nil, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), pr.GetNumRows())
+	pr.ReadStop()
+
+	assertConfigErrors(t, mapConfig{"Store_As": "parquet"}, []mapConfig{
+		{"Parquet_Compression": "lz4"},
+		{"Blob_Type": "append"},
+		{"Parquet_Schema_File": filepath.Join(dir, "missing.json")},
+	})
+}
+
+func TestAvroWriter(t *testing.T) {
+	ts := time.Unix(1602388800, 123000000)
+	record := map[interface{}]interface{}{
+		"log":  []byte("line"),
+		"code": 200,
+		"kubernetes": map[interface{}]interface{}{
+			"pod": "app-1",
+		},
+	}
+	raw, err := createAvroEvent(record, ts, "kube.app")
+	assert.Nil(t, err)
+
+	for _, compression := range []string{"deflate", "snappy", "null"} {
+		w, err := NewBatchWriter(&AzblobConfig{
+			StoreAs: AvroFormat, BlobType: BlockBlobType, AvroCompression: compression})
+		assert.Nil(t, err)
+		assert.Nil(t, w.Write(raw))
+		assert.Nil(t, w.Write(raw))
+		assert.NotNil(t, w.Write([]byte(`{"tag":"no timestamp"}`)))
+
+		payload, err := w.Close()
+		assert.Nil(t, err)
+
+		ocf, err := goavro.NewOCFReader(bytes.NewReader(payload))
+		assert.Nil(t, err)
+		assert.Equal(t, compression, ocf.CompressionName())
+
+		count := 0
+		for ocf.Scan() {
+			datum, err := ocf.Read()
+			assert.Nil(t, err)
+			assert.Equal(t, map[string]interface{}{
+				"timestamp": ts.Truncate(time.Millisecond).UTC(),
+				"tag":       "kube.app",
+				"record": map[string]interface{}{
+					"log":        "line",
+					"code":       "200",
+					"kubernetes": `{"pod":"app-1"}`,
+				},
+			}, datum)
+			count++
+		}
+		assert.Equal(t, 2, count, compression)
+	}
+
+	schema := `{"type":"record","name":"Line","namespace":"app","fields":[` +
+		`{"name":"log","type":"string"},` +
+		`{"name":"code","type":["null","long"],"default":null},` +
+		`{"name":"time","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+		`{"name":"user","type":["null",{"type":"record","name":"User","fields":[` +
+		`{"name":"id","type":["int","string"]}]}]},` +
+		`{"name":"tags","type":{"type":"array","items":["null","string"]}}]}`
+	dir, _ := ioutil.TempDir("", "avro")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schema.avsc")
+	assert.Nil(t, ioutil.WriteFile(path, []byte(schema), 0644))
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "fluentSAS",
+		"Store_As":              "avro",
+		"Avro_Schema_File":      path,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "deflate", cfg.AvroCompression)
+	assert.Equal(t, "", cfg.StoreAs.ContentEncoding())
+	assert.True(t, strings.HasSuffix(cfg.ObjectKeyFormat, ".avro"))
+
+	// records are plain JSON, unions take the first member matching
+	w, err := NewBatchWriter(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write([]byte(`{"log":"line1","code":200,`+
+		`"time":"2020-10-11T04:00:00Z","user":{"id":"u1"},"tags":["a",null]}`)))
+	assert.Nil(t, w.Write([]byte(`{"log":"line2","time":1602388800000,`+
+		`"user":{"id":7},"tags":[]}`)))
+	assert.NotNil(t, w.Write([]byte(`{"log":3,"time":0,"user":null,"tags":[]}`)))
+	assert.NotNil(t, w.Write([]byte(`{"log":"line3","time":0,"user":{"id":1.5},"tags":[]}`)))
+	payload, err := w.Close()
+	assert.Nil(t, err)
+
+	ocf, err := goavro.NewOCFReader(bytes.NewReader(payload))
+	assert.Nil(t, err)
+	var data []interface{}
+	for ocf.Scan() {
+		datum, err := ocf.Read()
+		assert.Nil(t, err)
+		data = append(data, datum)
 	}
-	assert.Equal(t, line, b.String())
+	millis := time.Date(2020, 10, 11, 4, 0, 0, 0, time.UTC)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"log": "line1", "code": map[string]interface{}{"long": int64(200)},
+			"time": millis, "user": map[string]interface{}{"app.User": map[string]interface{}{
+				"id": map[string]interface{}{"string": "u1"}}},
+			"tags": []interface{}{map[string]interface{}{"string": "a"}, nil}},
+		map[string]interface{}{
+			"log": "line2", "code": nil,
+			"time": millis, "user": map[string]interface{}{"app.User": map[string]interface{}{
+				"id": map[string]interface{}{"int": int32(7)}}},
+			"tags": []interface{}{}},
+	}, data)
+
+	// a record failing to encode fails its chunk
+	u := &AzblobUploader{config: cfg, logger: NewLogger("testing", logrus.TraceLevel)}
+	ack := NewAck()
+	ack.Add()
+	assert.Nil(t, u.newBatch(Entry{Raw: []byte(`{"log":3}`), Ack: ack}))
+	assert.NotNil(t, ack.Wait())
+
+	// the timestamp and tag fields of a schema are filled from the event
+	millis = ts.Truncate(time.Millisecond).UTC()
+	schema = `{"type":"record","name":"Line","fields":[` +
+		`{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+		`{"name":"tag","type":"string"},{"name":"log","type":"string"}]}`
+	assert.Nil(t, ioutil.WriteFile(path, []byte(schema), 0644))
+	cfg, err = NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "fluentSAS",
+		"Store_As":              "avro",
+		"Avro_Schema_File":      path,
+	})
+	assert.Nil(t, err)
+	w, err = NewBatchWriter(cfg)
+	assert.Nil(t, err)
+	raw, err = createAvroRecord(cfg.AvroSchema,
+		map[interface{}]interface{}{"log": []byte("line1")}, ts, "kube.app")
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write(raw))
+	raw, err = createAvroRecord(cfg.AvroSchema, map[interface{}]interface{}{
+		"log": "line2", "tag": "own"}, ts, "kube.app")
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write(raw))
+	payload, err = w.Close()
+	assert.Nil(t, err)
+
+	ocf, err = goavro.NewOCFReader(bytes.NewReader(payload))
+	assert.Nil(t, err)
+	data = nil
+	for ocf.Scan() {
+		datum, err := ocf.Read()
+		assert.Nil(t, err)
+		data = append(data, datum)
+	}
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"timestamp": millis, "tag": "kube.app", "log": "line1"},
+		map[string]interface{}{"timestamp": millis, "tag": "own", "log": "line2"},
+	}, data)
+
+	assertConfigErrors(t, mapConfig{"Store_As": "avro"}, []mapConfig{
+		{"Avro_Compression": "zstd"},
+		{"Blob_Type": "staged"},
+		{"Avro_Schema_File": filepath.Join(dir, "missing.avsc")},
+	})
+}
+
+func TestCSVFormat(t *testing.T) {
+	record := map[interface{}]interface{}{
+		"log":  []byte("say \"hi\", twice\n"),
+		"code": 200,
+		"kubernetes": map[interface{}]interface{}{
+			"pod":    "app-1",
+			"labels": map[interface{}]interface{}{"app": []byte("web")},
+		},
+		"tags": []interface{}{"a", 1},
+	}
+
+	for _, c := range []struct {
+		conf     mapConfig
+		expected string
+	}{
+		{mapConfig{
+			"Store_As":   "csv",
+			"Columns":    "$log, code=$code, $kubernetes['pod'], $kubernetes['labels'], $tags, $missing",
+			"Header_Row": "true",
+		}, "log,code,pod,labels,tags,missing\n" +
+			"\"say \"\"hi\"\", twice\n\",200,app-1,\"{\"\"app\"\":\"\"web\"\"}\",\"[\"\"a\"\",1]\","},
+		{mapConfig{
+			"Store_As":      "tsv",
+			"Columns":       "$code,$kubernetes.pod,$kubernetes.labels",
+			"Nested_Values": "drop",
+		}, "200\tapp-1\t"},
+	} {
+		c.conf["Azure_Container"] = "testContainer"
+		c.conf["Azure_Storage_Account"] = "testAccount"
+		c.conf["Azure_Storage_SAS"] = "fluentSAS"
+		cfg, err := NewConfig(c.conf)
+		assert.Nil(t, err)
+		assert.True(t, strings.HasSuffix(cfg.ObjectKeyFormat, "."+c.conf["Store_As"]))
+
+		raw, err := createRow(record, cfg)
+		assert.Nil(t, err)
+
+		w, err := NewBatchWriter(cfg)
+		assert.Nil(t, err)
+		assert.Nil(t, w.Write(raw))
+		payload, err := w.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, c.expected, string(payload))
+	}
+
+	assertConfigErrors(t, nil, []mapConfig{
+		{"Store_As": "csv"},
+		{"Store_As": "csv", "Columns": "log"},
+		{"Store_As": "tsv", "Columns": "$log", "Nested_Values": "flatten"},
+		{"Store_As": "csv", "Columns": "$log", "Header_Row": "true", "Blob_Type": "append"},
+	})
+}
+
+func TestMsgpackFormat(t *testing.T) {
+	ts := time.Unix(1602388800, 123456789)
+	first, err := createMsgpack(map[interface{}]interface{}{"log": "line1"}, ts)
+	assert.Nil(t, err)
+	// An event of an older Fluent Bit, with the timestamp in seconds and a
+	// fixext 1 value, which is not converted to JSON.
+	second := []byte("\x92\xce\x5f\x82\x83\x40\x82\xa3log\xa5line2\xa3ext\xd4\x07\x01")
+	chunk := append(append([]byte{}, first...), second...)
+
+	dec := NewEventDecoder(chunk)
+	event, ts1, record, err := dec.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, first, event)
+	assert.Equal(t, ts, ts1.(EventTime).Time)
+	assert.Equal(t, []byte("line1"), record["log"])
+
+	event, ts2, record, err := dec.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, second, event)
+	assert.Equal(t, uint64(1602388800), ts2)
+	assert.Equal(t, []byte("line2"), record["log"])
+
+	_, _, _, err = dec.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// A chunk cut in the middle of an event is not a clean end.
+	_, _, _, err = NewEventDecoder(first[:len(first)-2]).Next()
+	assert.NotNil(t, err)
+	assert.NotEqual(t, io.EOF, err)
+
+	_, _, _, err = NewEventDecoder([]byte("\x91\x01")).Next()
+	assert.NotNil(t, err)
+
+	// A Fluent Bit v2 event has a header of the timestamp and metadata.
+	v2 := append(append([]byte("\x92\x92"), first[1:11]...),
+		"\x81\xa3otl\xc0\x81\xa3log\xa5line1"...)
+	event, ts4, record, err := NewEventDecoder(v2).Next()
+	assert.Nil(t, err)
+	assert.Equal(t, first, event)
+	assert.Equal(t, ts, ts4.(EventTime).Time)
+	assert.Equal(t, []byte("line1"), record["log"])
+
+	_, _, _, err = NewEventDecoder(append([]byte("\x92\x91"),
+		first[1:]...)).Next()
+	assert.NotNil(t, err)
+
+	// An EventTime too short for the nanoseconds is left zero.
+	_, ts3, _, err := NewEventDecoder(
+		[]byte("\x92\xd6\x00\x5f\x82\x83\x40\x81\xa3log\xa5line3")).Next()
+	assert.Nil(t, err)
+	assert.True(t, ts3.(EventTime).IsZero())
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "fluentSAS",
+		"Store_As":              "msgpack",
+		"Blob_Type":             "append",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "", cfg.StoreAs.ContentEncoding())
+	assert.True(t, strings.HasSuffix(cfg.ObjectKeyFormat, ".msgpack"))
+
+	// Events are concatenated as they came in the chunk.
+	w, err := NewBatchWriter(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Write(first))
+	assert.Nil(t, w.Write(second))
+	payload, err := w.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, chunk, payload)
+}
+
+func TestFormatTemplate(t *testing.T) {
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "fluentSAS",
+		"Format_Template": `{{ rfc3339 .Time }} app={{ tagPart 1 .Tag }} ` +
+			`level={{ default "info" .Record.level }} ` +
+			`user={{ default "-" .Record.user }} msg={{ quote .Record.log }} ` +
+			`k8s={{ json .Record.kubernetes }} ts={{ unixMilli .Time }}` + "\n",
+	})
+	assert.Nil(t, err)
+
+	record := map[interface{}]interface{}{
+		"log":  []byte("say \"hi\""),
+		"user": "",
+		"kubernetes": map[interface{}]interface{}{
+			"pod": []byte("app-1"),
+		},
+	}
+	ts := time.Date(2020, 10, 11, 4, 0, 1, 500000000, time.UTC)
+	raw, err := createLine(cfg.FormatTemplate, record, ts, "kube.web")
+	assert.Nil(t, err)
+	assert.Equal(t, `2020-10-11T04:00:01.5Z app=web level=info user=- `+
+		`msg="say \"hi\"" k8s={"pod":"app-1"} ts=1602388801500`, string(raw))
+
+	raw, err = createLine(cfg.FormatTemplate, record, ts, "kube")
+	assert.Nil(t, err)
+	assert.True(t, strings.Contains(string(raw), " app= "))
+
+	// Missing fields looked up by get are empty.
+	cfg, err = NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "fluentSAS",
+		"Format_Template": `host={{ get .Record "host" }} ` +
+			`ns={{ get .Record "kubernetes" "ns" }} pod={{ get .Record "kubernetes" "pod" }} ` +
+			`{{ with $x := get .Record "log" }}msg={{ $x }}{{ end }}` +
+			`{{ range $k, $v := .Record.kubernetes }} {{ $k }}={{ $v }}{{ end }}` +
+			`{{ get .Record "log" "msg" | printf " %q" }}`,
+	})
+	assert.Nil(t, err)
+	raw, err = createLine(cfg.FormatTemplate, record, ts, "kube")
+	assert.Nil(t, err)
+	assert.Equal(t, `host= ns= pod=app-1 msg=say "hi" pod=app-1 ""`, string(raw))
+
+	// Records which fail to render are skipped, not retried with the chunk.
+	uploaded := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "PUT" {
+				body, _ := ioutil.ReadAll(r.Body)
+				uploaded <- string(body)
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+	defer server.Close()
+
+	cfg, err = NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "sig=fluentSAS",
+		"Azure_Endpoint":        server.URL,
+		"Delivery_Mode":         "sync",
+		"Store_As":              "text",
+		"Format_Template":       "{{ .Record.log.msg }}",
+	})
+	assert.Nil(t, err)
+	o, err := NewOperator(0, cfg)
+	assert.Nil(t, err)
+	defer o.uploader.Stop()
+
+	var chunk []byte
+	for _, r := range []map[interface{}]interface{}{
+		{"log": "not a map"},
+		{"log": map[interface{}]interface{}{"msg": "line1"}},
+	} {
+		event, err := createMsgpack(r, ts)
+		assert.Nil(t, err)
+		chunk = append(chunk, event...)
+	}
+	assert.Equal(t, output.FLB_OK, o.FlushChunk(chunk, "app"))
+	assert.Equal(t, "line1", <-uploaded)
+
+	assertConfigErrors(t, nil, []mapConfig{
+		{"Format_Template": "{{ .Record.log "},
+		{"Format_Template": "{{ .Record.log }}", "Store_As": "csv", "Columns": "$log"},
+	})
 }
 
 func TestFLBPluginExit(t *testing.T) {
@@ -189,13 +1373,369 @@ func TestRetry(t *testing.T) {
 
 }
 
+func TestAck(t *testing.T) {
+	ack := NewAck()
+	ack.Add()
+	ack.Add()
+
+	go ack.Done(nil)
+	go ack.Done(errors.New("upload failed"))
+
+	assert.EqualError(t, ack.Wait(), "upload failed")
+}
+
+func TestSyncDelivery(t *testing.T) {
+	for _, c := range []struct {
+		mode     string
+		limit    string
+		expected int // -1 is unlimited
+	}{
+		{"async", "", -1},
+		{"sync", "", DefaultSyncRetryLimit},
+		{"sync", "5", 5},
+	} {
+		cfg, err := NewConfig(mapConfig{
+			"Azure_Container":       "testContainer",
+			"Azure_Storage_Account": "testAccount",
+			"Azure_Storage_SAS":     "fluentSAS",
+			"Delivery_Mode":         c.mode,
+			"Batch_Retry_Limit":     c.limit,
+		})
+		assert.Nil(t, err)
+		if c.expected < 0 {
+			assert.Nil(t, cfg.BatchRetryLimit, c)
+		} else {
+			assert.Equal(t, uint64(c.expected), *cfg.BatchRetryLimit, c)
+		}
+	}
+
+	var failing int32 = 1
+	uploaded := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				return
+			}
+			if atomic.LoadInt32(&failing) == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			uploaded <- strings.TrimPrefix(r.URL.Path, "/testContainer/")
+			w.WriteHeader(http.StatusCreated)
+		}))
+	defer ts.Close()
+
+	cfg, err := NewConfig(mapConfig{
+		"Azure_Container":         "testContainer",
+		"Azure_Storage_Account":   "testAccount",
+		"Azure_Storage_SAS":       "sig=fluentSAS",
+		"Azure_Endpoint":          ts.URL,
+		"Azure_Object_Key_Format": "%{tag}/%{uuid}.log",
+		"Delivery_Mode":           "sync",
+		"Batch_Retry_Limit":       "0",
+		"Batch_Wait":              "60",
+	})
+	assert.Nil(t, err)
+	o, err := NewOperator(0, cfg)
+	assert.Nil(t, err)
+
+	// an open batch of another tag, which is not part of the chunk
+	assert.Nil(t, o.SendRecord(map[interface{}]interface{}{"log": "other"},
+		time.Now(), "other", nil))
+
+	var chunk []byte
+	for _, line := range []string{"line1", "line2"} {
+		event, _ := createMsgpack(
+			map[interface{}]interface{}{"log": line}, time.Now())
+		chunk = append(chunk, event...)
+	}
+
+	assert.Equal(t, output.FLB_RETRY, o.FlushChunk(chunk, "app"))
+
+	atomic.StoreInt32(&failing, 0)
+	assert.Equal(t, output.FLB_OK, o.FlushChunk(chunk, "app"))
+	assert.True(t, strings.HasPrefix(<-uploaded, "app/"))
+	assert.Empty(t, uploaded)
+
+	o.uploader.Stop()
+	assert.True(t, strings.HasPrefix(<-uploaded, "other/"))
+}
+
+func TestAppendBlobName(t *testing.T) {
+	assert.Equal(t, "logs/2020101100-00.gz",
+		appendBlobName("logs/2020101100-00.gz", 0))
+	assert.Equal(t, "logs/2020101100-00_2.gz",
+		appendBlobName("logs/2020101100-00.gz", 2))
+	assert.Equal(t, "logs.d/2020101100-00_1",
+		appendBlobName("logs.d/2020101100-00", 1))
+	assert.NotContains(t,
+		appendBlobName("logs/2020101100-00_%{uuid}.gz", 0), "%{uuid}")
+}
+
+func TestAppendBlobFull(t *testing.T) {
+	u := &AzblobUploader{config: &AzblobConfig{MaxBlobSize: 100}}
+
+	assert.False(t, u.appendBlobFull(&AppendTarget{}, 1, 200))
+	assert.False(t, u.appendBlobFull(&AppendTarget{blocks: 1, size: 50}, 1, 50))
+	assert.True(t, u.appendBlobFull(&AppendTarget{blocks: 1, size: 50}, 1, 51))
+	assert.True(t, u.appendBlobFull(
+		&AppendTarget{blocks: azblob.AppendBlobMaxBlocks, size: 1}, 1, 1))
+}
+
+func TestAppendBlobRetry(t *testing.T) {
+	var mu sync.Mutex
+	blobs := map[string][]byte{}
+	lost := 1 // responses of appended blocks which are lost
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+
+			name := strings.TrimPrefix(r.URL.Path, "/testContainer/")
+			b, ok := blobs[name]
+			switch {
+			case r.Method == "HEAD":
+				w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+				w.Header().Set("x-ms-blob-type", "AppendBlob")
+				w.Header().Set("x-ms-blob-committed-block-count", "1")
+			case r.Method == "GET":
+				var start, end int
+				fmt.Sscanf(r.Header.Get("x-ms-range"), "bytes=%d-%d", &start, &end)
+				w.Header().Set("Content-Length", strconv.Itoa(end-start+1))
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(b[start : end+1])
+			case r.Method == "PUT" && r.URL.Query().Get("comp") == "appendblock":
+				pos := r.Header.Get("x-ms-blob-condition-appendpos")
+				if pos != strconv.Itoa(len(b)) {
+					w.Header().Set("x-ms-error-code", "AppendPositionConditionNotMet")
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+				block, _ := ioutil.ReadAll(r.Body)
+				blobs[name] = append(b, block...)
+				if lost > 0 {
+					lost--
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			case r.Method == "PUT" && !ok:
+				blobs[name] = nil
+				w.WriteHeader(http.StatusCreated)
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+	defer ts.Close()
+
+	URL, _ := url.Parse(ts.URL + "/testContainer")
+	u := &AzblobUploader{
+		containers: []azblob.ContainerURL{azblob.NewContainerURL(*URL,
+			azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))},
+		config: &AzblobConfig{},
+		logger: NewLogger("testing", logrus.TraceLevel),
+	}
+
+	// A block appended by an attempt whose response is lost is not appended
+	// again.
+	target := &AppendTarget{}
+	written := 0
+	assert.NotNil(t, u.appendBlob(target, "app.log", []byte("line1\n"), &written))
+	assert.Nil(t, u.appendBlob(target, "app.log", []byte("line1\n"), &written))
+	assert.Equal(t, "line1\n", string(blobs["app.log"]))
+	assert.Equal(t, int64(6), target.size)
+
+	// A blob written by someone else is appended to at its new end.
+	blobs["app.log"] = append(blobs["app.log"], "other\n"...)
+	written = 0
+	assert.NotNil(t, u.appendBlob(target, "app.log", []byte("line2\n"), &written))
+	assert.Nil(t, u.appendBlob(target, "app.log", []byte("line2\n"), &written))
+	assert.Equal(t, "line1\nother\nline2\n", string(blobs["app.log"]))
+}
+
+func TestUploadIndexed(t *testing.T) {
+	var uploaded []string
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			name := strings.TrimPrefix(r.URL.Path, "/testContainer/")
+			switch {
+			case r.Method == "GET" && r.URL.Query().Get("comp") == "list":
+				assert.Equal(t, "logs/2020_", r.URL.Query().Get("prefix"))
+				w.Header().Set("Content-Type", "application/xml")
+				fmt.Fprint(w, `<?xml version="1.0" encoding="utf-8"?>`+
+					`<EnumerationResults><Blobs>`+
+					`<Blob><Name>logs/2020_3.gz</Name></Blob>`+
+					`<Blob><Name>logs/2020_12.gz.bak</Name></Blob>`+
+					`<Blob><Name>logs/2020_x.gz</Name></Blob>`+
+					`</Blobs><NextMarker /></EnumerationResults>`)
+			case r.Method == "PUT" && name == "logs/2020_4.gz":
+				assert.Equal(t, "*", r.Header.Get("If-None-Match"))
+				w.Header().Set("x-ms-error-code", "BlobAlreadyExists")
+				w.WriteHeader(http.StatusConflict)
+			case r.Method == "PUT":
+				uploaded = append(uploaded, name)
+				w.WriteHeader(http.StatusCreated)
+			}
+		}))
+	defer ts.Close()
+
+	URL, _ := url.Parse(ts.URL + "/testContainer")
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(),
+		azblob.PipelineOptions{})
+	u := &AzblobUploader{
+		containers:    []azblob.ContainerURL{azblob.NewContainerURL(*URL, p)},
+		config:        &AzblobConfig{},
+		logger:        NewLogger("testing", logrus.TraceLevel),
+		indexCounters: map[string]*IndexCounter{},
+	}
+
+	for i := 0; i < 2; i++ {
+		index := -1
+		err := u.uploadIndexed("logs/2020_%{index}.gz", []byte("log"), &index)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, []string{"logs/2020_5.gz", "logs/2020_6.gz"}, uploaded)
+
+	assert.Equal(t, "logs/2020_2.gz", appendBlobName("logs/2020_%{index}.gz", 2))
+}
+
+func TestStagedTargets(t *testing.T) {
+	fb, _ := NewFileBuffer(t.TempDir())
+
+	target := &StagedTarget{
+		Key:       "logs/2020101100-00.gz",
+		TimeSlice: "2020101100-00",
+		Name:      "logs/2020101100-00.gz",
+		BlockIDs:  []string{"YmxvY2sx", "YmxvY2sy"},
+		Size:      2048,
+	}
+	assert.Nil(t, fb.SaveStaged(target))
+
+	targets, err := fb.LoadStaged()
+	assert.Nil(t, err)
+	assert.Len(t, targets, 1)
+	assert.Equal(t, target.Name, targets[0].Name)
+	assert.Equal(t, target.BlockIDs, targets[0].BlockIDs)
+
+	assert.Nil(t, fb.RemoveStaged(target))
+	targets, _ = fb.LoadStaged()
+	assert.Empty(t, targets)
+
+	u := &AzblobUploader{config: &AzblobConfig{MaxBlobSize: 4096}}
+	assert.False(t, u.stagedBlobFull(target, 2048))
+	assert.True(t, u.stagedBlobFull(target, 2049))
+}
+
+// blockBlobServer fakes the block blob API used by Blob_Type staged.
+type blockBlobServer struct {
+	mu        sync.Mutex
+	blocks    map[string][]byte
+	committed map[string]string
+}
+
+func newBlockBlobServer(t *testing.T) (*blockBlobServer, azblob.ContainerURL) {
+	s := &blockBlobServer{blocks: map[string][]byte{}, committed: map[string]string{}}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			name := strings.TrimPrefix(r.URL.Path, "/testContainer/")
+			q := r.URL.Query()
+			switch {
+			case r.Method == "HEAD":
+				if _, ok := s.committed[name]; !ok {
+					w.WriteHeader(http.StatusNotFound)
+				}
+			case r.Method == "PUT" && q.Get("comp") == "block":
+				b, _ := ioutil.ReadAll(r.Body)
+				s.blocks[name+"/"+q.Get("blockid")] = b
+				w.WriteHeader(http.StatusCreated)
+			case r.Method == "PUT" && q.Get("comp") == "blocklist":
+				var list struct {
+					Latest []string `xml:"Latest"`
+				}
+				xml.NewDecoder(r.Body).Decode(&list)
+				var b []byte
+				for _, id := range list.Latest {
+					b = append(b, s.blocks[name+"/"+id]...)
+				}
+				s.committed[name] = string(b)
+				w.WriteHeader(http.StatusCreated)
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		}))
+	t.Cleanup(ts.Close)
+
+	URL, _ := url.Parse(ts.URL + "/testContainer")
+	p := azblob.NewPipeline(azblob.NewAnonymousCredential(),
+		azblob.PipelineOptions{})
+	return s, azblob.NewContainerURL(*URL, p)
+}
+
+func (s *blockBlobServer) blob(name string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.committed[name]
+	return b, ok
+}
+
+func TestStagedBlob(t *testing.T) {
+	server, container := newBlockBlobServer(t)
+	server.committed["logs/2020101100-00.log"] = "previous run\n"
+	server.committed["logs/2020101100-00_1.log"] = "previous run\n"
+
+	fb, _ := NewFileBuffer(t.TempDir())
+	newUploader := func() *AzblobUploader {
+		return &AzblobUploader{
+			containers: []azblob.ContainerURL{container},
+			buffer:     fb,
+			config: &AzblobConfig{
+				TimeSliceFormat: DefaultTimeSliceFormat,
+				Location:        time.UTC,
+			},
+			logger:        NewLogger("testing", logrus.TraceLevel),
+			stagedTargets: map[string]*StagedTarget{},
+		}
+	}
+
+	u := newUploader()
+	written := 0
+	assert.Nil(t, u.stageBlock("logs/2020101100-00.log", "2020101100-00",
+		[]byte("line1\n"), &written, false))
+	_, ok := server.blob("logs/2020101100-00_2.log")
+	assert.False(t, ok)
+
+	// a restart resumes the staged blocks
+	u = newUploader()
+	u.resumeStaged()
+	written = 0
+	assert.Nil(t, u.stageBlock("logs/2020101100-00.log", "2020101100-00",
+		[]byte("line2\n"), &written, true))
+	b, _ := server.blob("logs/2020101100-00_2.log")
+	assert.Equal(t, "line1\nline2\n", b)
+
+	u.commitTargets(true)
+	assert.Empty(t, u.stagedTargets)
+	targets, _ := fb.LoadStaged()
+	assert.Empty(t, targets)
+
+	// committed blobs are never replaced
+	b, _ = server.blob("logs/2020101100-00.log")
+	assert.Equal(t, "previous run\n", b)
+	b, _ = server.blob("logs/2020101100-00_1.log")
+	assert.Equal(t, "previous run\n", b)
+}
+
 func TestSendRecord(t *testing.T) {
 	c, _ := NewConfig(&mockConfig{})
 	o, _ := NewOperator(0, c)
 
 	record := make(map[interface{}]interface{})
 	record["key"] = "value"
-	err := o.SendRecord(record, time.Now())
+	err := o.SendRecord(record, time.Now(), "test", nil)
 	assert.Nil(t, err)
 
 	o = nil
@@ -218,6 +1758,82 @@ func TestUpload(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestFileBuffer(t *testing.T) {
+	fb, err := NewFileBuffer(t.TempDir())
+	if err != nil {
+		assert.Fail(t, "NewFileBuffer fails: %v", err)
+	}
+
+	s, err := fb.Create(SegmentHeader{TimeSlice: "2020101100-00"})
+	if err != nil {
+		assert.Fail(t, "create segment fails: %v", err)
+	}
+	assert.Nil(t, s.Append([]byte(`{"key":"value1"}`)))
+	assert.Nil(t, s.Append([]byte(`{"key":"value2"}`)))
+	assert.Nil(t, s.Seal())
+
+	// simulate a crash in the middle of a write
+	f, _ := os.OpenFile(s.Path(), os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write([]byte{0, 0, 0, 10, '{'})
+	f.Close()
+
+	paths, err := fb.Segments()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{s.Path()}, paths)
+
+	replayed, entries, err := ReadSegment(paths[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "2020101100-00", replayed.Header.TimeSlice)
+	assert.Equal(t, [][]byte{
+		[]byte(`{"key":"value1"}`), []byte(`{"key":"value2"}`)}, entries)
+
+	assert.Nil(t, replayed.Remove())
+	paths, _ = fb.Segments()
+	assert.Empty(t, paths)
+}
+
+func TestBufferRetry(t *testing.T) {
+	var puts int32
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "PUT" {
+				return
+			}
+			// the first upload fails
+			if atomic.AddInt32(&puts, 1) == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}))
+	defer ts.Close()
+
+	dir := t.TempDir()
+	c, err := NewConfig(mapConfig{
+		"Azure_Container":       "testContainer",
+		"Azure_Storage_Account": "testAccount",
+		"Azure_Storage_SAS":     "sig=fluentSAS",
+		"Azure_Endpoint":        ts.URL,
+		"Batch_Retry_Limit":     "0",
+		"Buffer_Path":           dir,
+	})
+	assert.Nil(t, err)
+	c.BufferRetry = 100 * time.Millisecond
+
+	u, err := NewUploader(c, NewLogger("testing", logrus.TraceLevel))
+	assert.Nil(t, err)
+	defer u.Stop()
+
+	u.Entries <- Entry{Key: "logs/%{uuid}.log", Raw: []byte(`{"key":"value"}`)}
+	u.Flush(nil)
+
+	fb, _ := NewFileBuffer(dir)
+	assert.Eventually(t, func() bool {
+		paths, _ := fb.Segments()
+		return atomic.LoadInt32(&puts) == 2 && len(paths) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
 func init() {
 	godotenv.Load("../../.env")
 }
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+const (
+	// ParquetSchemaSample is the number of records a schema is inferred from.
+	ParquetSchemaSample = 100
+	ParquetListElement  = "element"
+)
+
+// Parquet types of the fields, groups have no type.
+const (
+	ParquetBoolean = "BOOLEAN"
+	ParquetInt32   = "INT32"
+	ParquetInt64   = "INT64"
+	ParquetFloat   = "FLOAT"
+	ParquetDouble  = "DOUBLE"
+	ParquetString  = "BYTE_ARRAY"
+	ParquetList    = "LIST"
+)
+
+// ParquetField is a column, group or list of a Parquet schema.
+type ParquetField struct {
+	Name     string
+	Type     string
+	Required bool
+	Fields   []*ParquetField // children of a group
+	Element  *ParquetField   // element of a list
+}
+
+// ParquetSchema is the schema of the Parquet files, in the JSON format of
+// parquet-go, and the fields records are converted to.
+type ParquetSchema struct {
+	JSON string
+	Root *ParquetField
+}
+
+type parquetSchemaItem struct {
+	Tag    string               `json:"Tag"`
+	Fields []*parquetSchemaItem `json:"Fields,omitempty"`
+}
+
+// LoadParquetSchema reads a schema in the JSON format of parquet-go. Only
+// booleans, numbers, UTF8 strings, groups and lists are supported.
+func LoadParquetSchema(path string) (*ParquetSchema, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var item parquetSchemaItem
+	if err := json.Unmarshal(b, &item); err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", path, err)
+	}
+
+	root, err := parseParquetItem(&item)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema %s: %v", path, err)
+	}
+	if root.Type != "" {
+		return nil, fmt.Errorf("invalid schema %s: root must be a group", path)
+	}
+
+	return &ParquetSchema{JSON: string(b), Root: root}, nil
+}
+
+func parseParquetItem(item *parquetSchemaItem) (*ParquetField, error) {
+	tag := common.StringToTag(item.Tag)
+	f := &ParquetField{
+		Name:     tag.ExName,
+		Type:     tag.Type,
+		Required: tag.RepetitionType == parquet.FieldRepetitionType_REQUIRED,
+	}
+	if f.Name == "" {
+		return nil, fmt.Errorf("missing name in %q", item.Tag)
+	}
+	if tag.RepetitionType == parquet.FieldRepetitionType_REPEATED {
+		return nil, fmt.Errorf("repeated field %s, use a LIST", f.Name)
+	}
+
+	switch f.Type {
+	case "":
+		if len(item.Fields) == 0 {
+			return nil, fmt.Errorf("empty group %s", f.Name)
+		}
+		for _, sub := range item.Fields {
+			child, err := parseParquetItem(sub)
+			if err != nil {
+				return nil, err
+			}
+			f.Fields = append(f.Fields, child)
+		}
+	case ParquetList:
+		if len(item.Fields) != 1 {
+			return nil, fmt.Errorf("list %s must have one element", f.Name)
+		}
+		element, err := parseParquetItem(item.Fields[0])
+		if err != nil {
+			return nil, err
+		}
+		f.Element = element
+	case ParquetBoolean, ParquetInt32, ParquetInt64, ParquetFloat, ParquetDouble:
+	case ParquetString:
+		if tag.ConvertedType != "UTF8" {
+			return nil, fmt.Errorf("field %s must be UTF8", f.Name)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %s of field %s", f.Type, f.Name)
+	}
+
+	return f, nil
+}
+
+// inferParquetSchema builds a schema of optional fields from sample records.
+// Fields with conflicting types are stored as strings.
+func inferParquetSchema(records []map[string]interface{}) (*ParquetSchema, error) {
+	var root *ParquetField
+	for _, r := range records {
+		root = mergeParquetField(root, inferParquetField("parquet_go_root", r))
+	}
+	if root == nil {
+		return nil, fmt.Errorf("no fields to infer a parquet schema from")
+	}
+	root.Required = true
+
+	b, err := json.Marshal(root.schemaItem())
+	if err != nil {
+		return nil, err
+	}
+
+	return &ParquetSchema{JSON: string(b), Root: root}, nil
+}
+
+// inferParquetField returns the field of a JSON value, or nil if the type of
+// the value is unknown, e.g. null or an empty object.
+func inferParquetField(name string, v interface{}) *ParquetField {
+	switch t := v.(type) {
+	case bool:
+		return &ParquetField{Name: name, Type: ParquetBoolean}
+	case json.Number:
+		if _, err := t.Int64(); err == nil {
+			return &ParquetField{Name: name, Type: ParquetInt64}
+		}
+		return &ParquetField{Name: name, Type: ParquetDouble}
+	case string:
+		return &ParquetField{Name: name, Type: ParquetString}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var group *ParquetField
+		for _, k := range keys {
+			// The keys end up in the tags of parquet-go.
+			if k == "" || strings.ContainsAny(k, ",=") {
+				continue
+			}
+			child := inferParquetField(k, t[k])
+			if child == nil {
+				continue
+			}
+			group = mergeParquetField(group, &ParquetField{
+				Name: name, Fields: []*ParquetField{child}})
+		}
+		return group
+	case []interface{}:
+		var element *ParquetField
+		for _, e := range t {
+			element = mergeParquetField(
+				element, inferParquetField(ParquetListElement, e))
+		}
+		if element == nil {
+			return nil
+		}
+		return &ParquetField{Name: name, Type: ParquetList, Element: element}
+	}
+
+	return nil
+}
+
+func mergeParquetField(a, b *ParquetField) *ParquetField {
+	switch {
+	case a == nil:
+		return b
+	case b == nil:
+		return a
+	case a.Type == "" && b.Type == "":
+		for _, child := range b.Fields {
+			i := a.field(child.Name)
+			if i < 0 {
+				a.Fields = append(a.Fields, child)
+				continue
+			}
+			a.Fields[i] = mergeParquetField(a.Fields[i], child)
+		}
+		return a
+	case a.Type == ParquetList && b.Type == ParquetList:
+		a.Element = mergeParquetField(a.Element, b.Element)
+		return a
+	case a.Type == b.Type:
+		return a
+	case a.isNumber() && b.isNumber():
+		return &ParquetField{Name: a.Name, Type: ParquetDouble}
+	}
+
+	return &ParquetField{Name: a.Name, Type: ParquetString}
+}
+
+// field returns the index of a child, matched the way parquet-go matches
+// the keys of a JSON record.
+func (f *ParquetField) field(name string) int {
+	for i, child := range f.Fields {
+		if common.StringToVariableName(child.Name) ==
+			common.StringToVariableName(name) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func (f *ParquetField) isNumber() bool {
+	switch f.Type {
+	case ParquetInt32, ParquetInt64, ParquetFloat, ParquetDouble:
+		return true
+	}
+
+	return false
+}
+
+func (f *ParquetField) schemaItem() *parquetSchemaItem {
+	repetition := "OPTIONAL"
+	if f.Required {
+		repetition = "REQUIRED"
+	}
+
+	item := &parquetSchemaItem{}
+	switch f.Type {
+	case "":
+		item.Tag = fmt.Sprintf("name=%s, repetitiontype=%s", f.Name, repetition)
+		for _, child := range f.Fields {
+			item.Fields = append(item.Fields, child.schemaItem())
+		}
+	case ParquetList:
+		item.Tag = fmt.Sprintf(
+			"name=%s, type=LIST, repetitiontype=%s", f.Name, repetition)
+		item.Fields = []*parquetSchemaItem{f.Element.schemaItem()}
+	case ParquetString:
+		item.Tag = fmt.Sprintf("name=%s, type=BYTE_ARRAY, convertedtype=UTF8, "+
+			"repetitiontype=%s", f.Name, repetition)
+	default:
+		item.Tag = fmt.Sprintf(
+			"name=%s, type=%s, repetitiontype=%s", f.Name, f.Type, repetition)
+	}
+
+	return item
+}
+
+// convert returns v in the shape of the field, so that parquet-go does not
+// fail on records which do not match the schema. Values of another type are
+// dropped, except for strings, which take any value encoded as JSON.
+func (f *ParquetField) convert(v interface{}) (interface{}, error) {
+	var out interface{}
+	switch f.Type {
+	case "":
+		if m, ok := v.(map[string]interface{}); ok {
+			group := map[string]interface{}{}
+			for _, child := range f.Fields {
+				cv, err := child.convert(m[child.Name])
+				if err != nil {
+					return nil, err
+				}
+				if cv != nil {
+					group[child.Name] = cv
+				}
+			}
+			out = group
+		}
+	case ParquetList:
+		if l, ok := v.([]interface{}); ok {
+			list := []interface{}{}
+			for _, e := range l {
+				cv, err := f.Element.convert(e)
+				if err != nil {
+					return nil, err
+				}
+				// parquet-go cannot write null elements.
+				if cv != nil {
+					list = append(list, cv)
+				}
+			}
+			out = list
+		}
+	case ParquetString:
+		switch t := v.(type) {
+		case nil:
+		case string:
+			out = t
+		default:
+			b, err := json.Marshal(t)
+			if err != nil {
+				return nil, err
+			}
+			out = string(b)
+		}
+	case ParquetBoolean:
+		if b, ok := v.(bool); ok {
+			out = b
+		}
+	case ParquetInt32, ParquetInt64:
+		if n, ok := v.(json.Number); ok {
+			if _, err := n.Int64(); err == nil {
+				out = n
+			}
+		}
+	case ParquetFloat, ParquetDouble:
+		if n, ok := v.(json.Number); ok {
+			if _, err := n.Float64(); err == nil {
+				out = n
+			}
+		}
+	}
+
+	if out == nil && f.Required {
+		return nil, fmt.Errorf("missing required parquet field %s", f.Name)
+	}
+
+	return out, nil
+}
+
+// parquetWriter writes a batch as a Parquet file. Without a configured
+// schema, the first records are kept until a schema is inferred from them.
+type parquetWriter struct {
+	buf        bytes.Buffer
+	codec      parquet.CompressionCodec
+	schema     *ParquetSchema
+	sample     []map[string]interface{}
+	sampleSize int
+	inferable  bool
+	pw         *writer.JSONWriter
+	err        error
+}
+
+func newParquetWriter(c *AzblobConfig) *parquetWriter {
+	return &parquetWriter{codec: c.ParquetCodec, schema: c.ParquetSchema}
+}
+
+func (w *parquetWriter) Write(raw []byte) error {
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+
+	var record map[string]interface{}
+	if err := d.Decode(&record); err != nil {
+		return err
+	}
+
+	if w.err != nil {
+		return nil
+	}
+	if w.pw != nil {
+		return w.write(record)
+	}
+
+	w.sample = append(w.sample, record)
+	w.sampleSize += len(raw)
+	// Records without a typed value, e.g. {} or nulls only, leave nothing to
+	// infer a schema from, so sampling goes on until a record has one.
+	if w.schema == nil {
+		w.inferable = w.inferable ||
+			inferParquetField("parquet_go_root", record) != nil
+		if len(w.sample) < ParquetSchemaSample || !w.inferable {
+			return nil
+		}
+	}
+
+	return w.open()
+}
+
+// open writes the sampled records once the schema is known. Only the error
+// of the last sampled record, which is being written, is returned. Earlier
+// records failing the schema are skipped, as their writes have succeeded,
+// and errors of the whole batch are returned by Close.
+func (w *parquetWriter) open() error {
+	if w.schema == nil {
+		schema, err := inferParquetSchema(w.sample)
+		if err != nil {
+			w.err = err
+			return nil
+		}
+		w.schema = schema
+	}
+
+	pw, err := writer.NewJSONWriterFromWriter(w.schema.JSON, &w.buf, 1)
+	if err != nil {
+		w.err = fmt.Errorf("invalid parquet schema: %v", err)
+		return nil
+	}
+	pw.CompressionType = w.codec
+	w.pw = pw
+
+	var lastErr error
+	for i, record := range w.sample {
+		if err := w.write(record); err != nil && i == len(w.sample)-1 {
+			lastErr = err
+		}
+	}
+	w.sample, w.sampleSize = nil, 0
+
+	return lastErr
+}
+
+func (w *parquetWriter) write(record map[string]interface{}) error {
+	v, err := w.schema.Root.convert(record)
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return w.pw.Write(string(b))
+}
+
+// Size includes the rows parquet-go has not written out yet.
+func (w *parquetWriter) Size() int {
+	if w.pw == nil {
+		return w.sampleSize
+	}
+
+	return w.buf.Len() + int(w.pw.Size+w.pw.ObjsSize)
+}
+
+func (w *parquetWriter) Close() ([]byte, error) {
+	if w.pw == nil && w.err == nil {
+		// The sampled records have all been accepted, so one failing the
+		// schema is skipped as well.
+		w.open()
+	}
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	if err := w.pw.WriteStop(); err != nil {
+		return nil, err
+	}
+
+	return w.buf.Bytes(), nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	DefaultKeyFallback = "unknown"
+	MaxKeyFieldLength  = 128
+)
+
+var keyFieldPattern = regexp.MustCompile(`%\{(\$[^}]*)\}`)
+
+// RecordAccessor selects a value of a record, like the record accessor of
+// Fluent Bit, e.g. $kubernetes['namespace_name'], $.level or $items[0].
+type RecordAccessor struct {
+	pattern string
+	path    []interface{} // string keys and int indexes
+}
+
+// KeyField is a record accessor placeholder of the object key format.
+type KeyField struct {
+	Placeholder string
+	Accessor    *RecordAccessor
+}
+
+func NewRecordAccessor(pattern string) (*RecordAccessor, error) {
+	if !strings.HasPrefix(pattern, "$") {
+		return nil, fmt.Errorf("record accessor %s must start with $", pattern)
+	}
+
+	ra := &RecordAccessor{pattern: pattern}
+	s := strings.TrimPrefix(pattern[1:], ".")
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in record accessor %s", pattern)
+			}
+			sub := s[i+1 : i+end]
+			i += end + 1
+
+			if len(sub) >= 2 && (sub[0] == '\'' || sub[0] == '"') &&
+				sub[len(sub)-1] == sub[0] {
+				ra.path = append(ra.path, sub[1:len(sub)-1])
+				continue
+			}
+
+			index, err := strconv.Atoi(sub)
+			if err != nil || index < 0 {
+				return nil, fmt.Errorf(
+					"invalid subscript [%s] in record accessor %s", sub, pattern)
+			}
+			ra.path = append(ra.path, index)
+		case '.':
+			if i+1 == len(s) || s[i+1] == '.' || s[i+1] == '[' {
+				return nil, fmt.Errorf("empty key in record accessor %s", pattern)
+			}
+			i++
+		default:
+			end := strings.IndexAny(s[i:], ".[")
+			if end < 0 {
+				end = len(s) - i
+			}
+			ra.path = append(ra.path, s[i:i+end])
+			i += end
+		}
+	}
+
+	if len(ra.path) == 0 {
+		return nil, fmt.Errorf("empty record accessor %s", pattern)
+	}
+
+	return ra, nil
+}
+
+// Get returns the selected value, or false if the record does not have it.
+func (ra *RecordAccessor) Get(record map[interface{}]interface{}) (interface{}, bool) {
+	var v interface{} = record
+	for _, p := range ra.path {
+		switch t := v.(type) {
+		case map[interface{}]interface{}:
+			key, ok := p.(string)
+			if !ok {
+				return nil, false
+			}
+			if v, ok = t[key]; !ok {
+				return nil, false
+			}
+		case map[string]interface{}:
+			key, ok := p.(string)
+			if !ok {
+				return nil, false
+			}
+			if v, ok = t[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			index, ok := p.(int)
+			if !ok || index >= len(t) {
+				return nil, false
+			}
+			v = t[index]
+		default:
+			return nil, false
+		}
+	}
+
+	return v, true
+}
+
+func (ra *RecordAccessor) String() string {
+	return ra.pattern
+}
+
+// parseKeyFields returns the record accessor placeholders of an object key
+// format, e.g. %{$kubernetes['namespace_name']}.
+func parseKeyFields(format string) ([]KeyField, error) {
+	var fields []KeyField
+	for _, m := range keyFieldPattern.FindAllStringSubmatch(format, -1) {
+		ra, err := NewRecordAccessor(m[1])
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, KeyField{Placeholder: m[0], Accessor: ra})
+	}
+
+	return fields, nil
+}
+
+// renderKeyFields replaces the record accessor placeholders of key with the
+// values of the record. Missing and non-scalar values are rendered as
+// fallback.
+func renderKeyFields(key string, fields []KeyField,
+	record map[interface{}]interface{}, fallback string) string {
+	for _, f := range fields {
+		value := fallback
+		if v, ok := f.Accessor.Get(record); ok {
+			if s := sanitizeKeyField(v); s != "" {
+				value = s
+			}
+		}
+		key = strings.ReplaceAll(key, f.Placeholder, value)
+	}
+
+	return key
+}
+
+// sanitizeKeyField turns a record value into a single path segment of a blob
+// name. Path separators, control characters and a trailing dot are escaped as
+// %XX, and so is % itself. A value longer than MaxKeyFieldLength once escaped
+// is cut and ends with %~ and a hash of the whole value, which an escaped
+// value never does, so that distinct values never share a segment. An empty
+// string is returned for an empty value.
+func sanitizeKeyField(v interface{}) string {
+	var s string
+	switch t := v.(type) {
+	case string:
+		s = t
+	case []byte:
+		s = string(t)
+	case int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64, float32, float64, bool:
+		s = fmt.Sprint(t)
+	default:
+		return ""
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		// Blob names ending with a dot, or dot segments, are not allowed.
+		dot := c == '.' && (i == len(s)-1 || s[i+1] == '.')
+		if c == '/' || c == '\\' || c == '%' || c < 0x20 || c == 0x7f || dot {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	escaped := b.String()
+	if len(escaped) <= MaxKeyFieldLength {
+		return escaped
+	}
+
+	sum := sha256.Sum256([]byte(s))
+	suffix := fmt.Sprintf("%%~%x", sum[:8])
+
+	// Do not cut a character or an escape in half.
+	n := MaxKeyFieldLength - len(suffix)
+	for n > 0 && !utf8.RuneStart(escaped[n]) {
+		n--
+	}
+	if escaped[n-1] == '%' {
+		n--
+	} else if escaped[n-2] == '%' {
+		n -= 2
+	}
+
+	return escaped[:n] + suffix
+}
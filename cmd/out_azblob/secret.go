@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultSecretRefresh = 30 * time.Second
+	SASExpiryWarning     = 24 * time.Hour
+	SASWarningInterval   = time.Hour
+)
+
+// SecretWatcher polls a secret file, e.g. a mounted Kubernetes secret, and
+// calls onChange with the new content whenever the file changes.
+type SecretWatcher struct {
+	path     string
+	interval time.Duration
+	current  string
+	onChange func(secret string) error
+	quit     chan struct{}
+	once     sync.Once
+	wg       sync.WaitGroup
+}
+
+// ReadSecretFile returns the content of a secret file without surrounding
+// whitespace.
+func ReadSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("secret file %s is empty", path)
+	}
+
+	return secret, nil
+}
+
+func NewSecretWatcher(path string, interval time.Duration, current string,
+	onChange func(secret string) error) *SecretWatcher {
+	w := &SecretWatcher{
+		path:     path,
+		interval: interval,
+		current:  current,
+		onChange: onChange,
+		quit:     make(chan struct{}),
+	}
+
+	w.wg.Add(1)
+	go w.start()
+
+	return w
+}
+
+func (w *SecretWatcher) start() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			secret, err := ReadSecretFile(w.path)
+			if err != nil {
+				logger.Warnf("read secret file error: %v", err)
+				continue
+			}
+			if secret == w.current {
+				continue
+			}
+
+			// Keep the previous secret if the new one is unusable, and try
+			// again on the next tick.
+			if err := w.onChange(secret); err != nil {
+				logger.Warnf("rotate secret error, file=%s: %v", w.path, err)
+				continue
+			}
+			w.current = secret
+		}
+	}
+}
+
+func (w *SecretWatcher) Stop() {
+	w.once.Do(func() { close(w.quit) })
+	w.wg.Wait()
+}
+
+// sasExpiry returns the expiry time (se) of a SAS token.
+func sasExpiry(sas string) (time.Time, bool) {
+	params, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	se := params.Get("se")
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z", "2006-01-02"} {
+		if t, err := time.Parse(layout, se); err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
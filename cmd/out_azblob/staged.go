@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	uuid "github.com/satori/go.uuid"
+)
+
+// StagedTarget is the block blob currently built for an object key. Its
+// blocks are staged batch by batch and committed all at once.
+type StagedTarget struct {
+	Key       string    `json:"key"`
+	TimeSlice string    `json:"time_slice"`
+	Name      string    `json:"name"`
+	Seq       int       `json:"seq"`
+	BlockIDs  []string  `json:"block_ids"`
+	Size      int64     `json:"size"`
+	StagedAt  time.Time `json:"staged_at"`
+
+	mu      sync.Mutex
+	removed bool
+}
+
+// lockStagedTarget returns the locked target of an object key. Targets which
+// got committed and removed in the meantime are not returned.
+func (u *AzblobUploader) lockStagedTarget(
+	key, timeSlice string) *StagedTarget {
+	for {
+		u.mu.Lock()
+		t, ok := u.stagedTargets[key]
+		if !ok {
+			t = &StagedTarget{Key: key, TimeSlice: timeSlice}
+			u.stagedTargets[key] = t
+		}
+		u.mu.Unlock()
+
+		t.mu.Lock()
+		if !t.removed {
+			return t
+		}
+		t.mu.Unlock()
+	}
+}
+
+// stageBlock stages b as new blocks of the blob of the object key. The blob
+// is committed first if b does not fit into it anymore. Bytes already staged
+// by a previous attempt are tracked in written and skipped. With commit set,
+// the blocks staged so far are committed as well, so that b is readable once
+// stageBlock returns.
+func (u *AzblobUploader) stageBlock(
+	key, timeSlice string, b []byte, written *int, commit bool) error {
+	ctx, cancel := context.WithTimeout(
+		context.Background(), Timeout*time.Second)
+	defer cancel()
+
+	if u.config.AutoCreateContainer {
+		err := u.ensureContainer(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	t := u.lockStagedTarget(key, timeSlice)
+	defer t.mu.Unlock()
+
+	if *written == 0 && t.Name != "" && u.stagedBlobFull(t, len(b)) {
+		u.logger.Infof("max blob size reached, blob=%s blocks=%d size=%d",
+			t.Name, len(t.BlockIDs), t.Size)
+		if err := u.commitTarget(ctx, t); err != nil {
+			return err
+		}
+	}
+
+	if t.Name == "" {
+		name, err := u.stagedBlobName(ctx, t)
+		if err != nil {
+			return err
+		}
+		t.Name = name
+	}
+
+	blobURL := u.containerURL().NewBlockBlobURL(t.Name)
+	for *written < len(b) {
+		end := *written + azblob.BlockBlobMaxStageBlockBytes
+		if end > len(b) {
+			end = len(b)
+		}
+
+		id := base64.StdEncoding.EncodeToString(uuid.NewV4().Bytes())
+		_, err := blobURL.StageBlock(ctx, id, bytes.NewReader(b[*written:end]),
+			azblob.LeaseAccessConditions{}, nil)
+		if err != nil {
+			u.logger.Errorf("stage block error: %s", err.Error())
+			return err
+		}
+
+		t.BlockIDs = append(t.BlockIDs, id)
+		t.Size += int64(end - *written)
+		t.StagedAt = time.Now()
+		*written = end
+	}
+
+	if u.buffer != nil {
+		if err := u.buffer.SaveStaged(t); err != nil {
+			u.logger.Warnf("save staged blocks error: %v", err)
+		}
+	}
+
+	if commit {
+		return u.commitBlocks(ctx, t)
+	}
+
+	return nil
+}
+
+func (u *AzblobUploader) stagedBlobFull(t *StagedTarget, size int) bool {
+	if len(t.BlockIDs) == 0 {
+		return false
+	}
+
+	blocks := (size + azblob.BlockBlobMaxStageBlockBytes - 1) /
+		azblob.BlockBlobMaxStageBlockBytes
+	if len(t.BlockIDs)+blocks > azblob.BlockBlobMaxBlocks {
+		return true
+	}
+
+	return u.config.MaxBlobSize > 0 &&
+		t.Size+int64(size) > int64(u.config.MaxBlobSize)
+}
+
+// stagedBlobName picks the name of the next blob of a target, skipping the
+// names which have been committed already, e.g. by a previous run.
+func (u *AzblobUploader) stagedBlobName(
+	ctx context.Context, t *StagedTarget) (string, error) {
+	for {
+		name := appendBlobName(t.Key, t.Seq)
+		if hasUniqueName(t.Key) && !strings.Contains(t.Key, "%{index}") {
+			return name, nil
+		}
+
+		_, err := u.containerURL().NewBlobURL(name).GetProperties(
+			ctx, azblob.BlobAccessConditions{})
+		if err == nil {
+			t.Seq++
+			continue
+		}
+		if serr, ok := err.(azblob.StorageError); ok &&
+			serr.Response().StatusCode == 404 {
+			return name, nil
+		}
+
+		return "", err
+	}
+}
+
+// commitTarget commits the staged blocks of a target and resets it for the
+// next blob.
+func (u *AzblobUploader) commitTarget(
+	ctx context.Context, t *StagedTarget) error {
+	if len(t.BlockIDs) == 0 {
+		return nil
+	}
+
+	if err := u.commitBlocks(ctx, t); err != nil {
+		return err
+	}
+
+	if u.buffer != nil {
+		if err := u.buffer.RemoveStaged(t); err != nil {
+			u.logger.Warnf("remove staged blocks error: %v", err)
+		}
+	}
+
+	t.Name = ""
+	t.Seq++
+	t.BlockIDs = nil
+	t.Size = 0
+
+	return nil
+}
+
+// commitBlocks commits the blocks of a target staged so far. The target stays
+// open, blocks staged later are committed together with these ones.
+func (u *AzblobUploader) commitBlocks(
+	ctx context.Context, t *StagedTarget) error {
+	blobURL := u.containerURL().NewBlockBlobURL(t.Name)
+	_, err := blobURL.CommitBlockList(ctx, t.BlockIDs, azblob.BlobHTTPHeaders{
+		ContentEncoding: u.config.StoreAs.ContentEncoding(),
+	}, azblob.Metadata{}, azblob.BlobAccessConditions{})
+	if err != nil {
+		u.logger.Errorf("commit block list error: %s", err.Error())
+		return err
+	}
+
+	u.logger.Debugf("commit blob=%s blocks=%d size=%d",
+		t.Name, len(t.BlockIDs), t.Size)
+
+	return nil
+}
+
+// commitTargets commits the targets whose time slice has passed and which
+// have been idle for Batch_Wait, or all of them if force is set.
+func (u *AzblobUploader) commitTargets(force bool) {
+	now := time.Now()
+	timeSlice := now.In(u.config.Location).Format(u.config.TimeSliceFormat)
+
+	u.mu.Lock()
+	var targets []*StagedTarget
+	for _, t := range u.stagedTargets {
+		targets = append(targets, t)
+	}
+	u.mu.Unlock()
+
+	for _, t := range targets {
+		t.mu.Lock()
+		closed := force || (t.TimeSlice != timeSlice &&
+			now.Sub(t.StagedAt) >= u.config.BatchWait)
+		t.mu.Unlock()
+		if !closed {
+			continue
+		}
+
+		err := retry(u.config.BatchRetryLimit, func() error {
+			ctx, cancel := context.WithTimeout(
+				context.Background(), Timeout*time.Second)
+			defer cancel()
+
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			return u.withFailover(func() error {
+				return u.commitTarget(ctx, t)
+			})
+		})
+		if err != nil {
+			u.logger.Errorf("retry limit reached, blob=%s", t.Name)
+			continue
+		}
+
+		u.mu.Lock()
+		t.mu.Lock()
+		if len(t.BlockIDs) == 0 {
+			t.removed = true
+			delete(u.stagedTargets, t.Key)
+		}
+		t.mu.Unlock()
+		u.mu.Unlock()
+	}
+}
+
+// resumeStaged loads the targets left uncommitted by a previous run, so that
+// their blocks get committed instead of uploaded again.
+func (u *AzblobUploader) resumeStaged() {
+	targets, err := u.buffer.LoadStaged()
+	if err != nil {
+		u.logger.Errorf("load staged blocks error: %v", err)
+		return
+	}
+
+	for _, t := range targets {
+		u.logger.Infof("resume staged blob=%s blocks=%d", t.Name, len(t.BlockIDs))
+		u.stagedTargets[t.Key] = t
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// TemplateData is the data of Format_Template. Time is in Time_Zone.
+type TemplateData struct {
+	Time   time.Time
+	Tag    string
+	Record map[string]interface{}
+}
+
+var templateFuncs = template.FuncMap{
+	// {{ json .Record.kubernetes }} encodes a value as JSON.
+	"json": func(v interface{}) (string, error) {
+		js, err := jsoniter.Marshal(v)
+		return string(js), err
+	},
+	// {{ default "-" .Record.user }} is "-" for a missing or empty value.
+	"default": func(fallback, v interface{}) interface{} {
+		if v == nil || v == "" {
+			return fallback
+		}
+		return v
+	},
+	// {{ get .Record "kubernetes" "namespace_name" }} looks up a nested field,
+	// which is empty when it is missing.
+	"get": func(v interface{}, keys ...string) interface{} {
+		for _, k := range keys {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return ""
+			}
+			if v, ok = m[k]; !ok || v == nil {
+				return ""
+			}
+		}
+		return v
+	},
+	// {{ quote .Record.log }} quotes a value with Go escapes, e.g. for logfmt.
+	"quote": func(v interface{}) string {
+		if s, ok := v.(string); ok {
+			return strconv.Quote(s)
+		}
+		return strconv.Quote(fmt.Sprint(v))
+	},
+	// {{ timeFormat "Jan _2 15:04:05" .Time }} formats a time by a Go layout.
+	"timeFormat": func(layout string, t time.Time) string {
+		return t.Format(layout)
+	},
+	"rfc3339": func(t time.Time) string {
+		return t.Format(time.RFC3339Nano)
+	},
+	"unix": func(t time.Time) int64 {
+		return t.Unix()
+	},
+	"unixMilli": func(t time.Time) int64 {
+		return t.UnixNano() / int64(time.Millisecond)
+	},
+	// {{ tagPart 1 .Tag }} is the N-th part of the tag split by ".".
+	"tagPart": func(i int, tag string) string {
+		parts := strings.Split(tag, ".")
+		if i < 0 || i >= len(parts) {
+			return ""
+		}
+		return parts[i]
+	},
+}
+
+// parseFormatTemplate parses a Go text/template, which renders a record to a
+// line in place of JSON.
+func parseFormatTemplate(text string) (*template.Template, error) {
+	return template.New("Format_Template").Funcs(templateFuncs).Parse(text)
+}
+
+// createLine renders a record with the template. A trailing line break is
+// removed, as the entries of a batch are separated by line breaks.
+func createLine(t *template.Template, record map[interface{}]interface{},
+	ts time.Time, tag string) ([]byte, error) {
+	data := TemplateData{
+		Time:   ts,
+		Tag:    tag,
+		Record: jsonValue(record).(map[string]interface{}),
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -1,16 +1,15 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
 	"context"
 	"math/rand"
+	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
-	uuid "github.com/satori/go.uuid"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,27 +22,64 @@ const (
 )
 
 type Batch struct {
-	Buffer    []byte
+	Tag       string
+	Key       string
+	Time      time.Time
+	TimeSlice string
+	Writer    BatchWriter
 	CreatedAt time.Time
+	Segment   *Segment
+	Acks      []*Ack
 }
 
+// Entry is a single record. Key is the object key format with the tag and
+// the fields of the record rendered.
 type Entry struct {
+	Tag       string
+	Key       string
+	Time      time.Time
 	TimeSlice string
 	Raw       []byte
+	Ack       *Ack
+}
+
+// Ack tracks the entries of a single Fluent Bit flush until the batches
+// containing them have been uploaded or given up.
+type Ack struct {
+	wg  sync.WaitGroup
+	mu  sync.Mutex
+	err error
 }
 
 type Func func() error
 
 type AzblobUploader struct {
-	Entries    chan Entry
-	batches    map[string]*Batch
-	container  azblob.ContainerURL
-	timeTicker *time.Ticker
-	quit       chan struct{}
-	once       sync.Once
-	wg         sync.WaitGroup
-	config     *AzblobConfig
-	logger     *logrus.Entry
+	Entries     chan Entry
+	flush       chan *Ack
+	batches     map[string]*Batch
+	buffer      *FileBuffer
+	segments    map[string]bool
+	containers  []azblob.ContainerURL
+	secrets     *SecretWatcher
+	tokens      *TokenRefresher
+	timeTicker  *time.Ticker
+	retryTicker *time.Ticker
+	quit        chan struct{}
+	once        sync.Once
+	wg          sync.WaitGroup
+	mu          sync.Mutex
+	config      *AzblobConfig
+	logger      *logrus.Entry
+
+	appendTargets map[string]*AppendTarget
+	stagedTargets map[string]*StagedTarget
+	indexCounters map[string]*IndexCounter
+	committing    int32
+	sending       sync.WaitGroup
+
+	containerMu sync.RWMutex
+	active      int
+	sasWarnedAt time.Time
 }
 
 func NewUploader(c *AzblobConfig, l *logrus.Entry) (*AzblobUploader, error) {
@@ -54,12 +90,54 @@ func NewUploader(c *AzblobConfig, l *logrus.Entry) (*AzblobUploader, error) {
 
 	u := &AzblobUploader{
 		Entries:    make(chan Entry),
+		flush:      make(chan *Ack),
 		batches:    map[string]*Batch{},
-		container:  c.ContainerURL,
+		segments:   map[string]bool{},
+		containers: []azblob.ContainerURL{c.ContainerURL},
 		timeTicker: time.NewTicker(checkInterval),
 		quit:       make(chan struct{}),
 		config:     c,
 		logger:     l,
+
+		appendTargets: map[string]*AppendTarget{},
+		stagedTargets: map[string]*StagedTarget{},
+		indexCounters: map[string]*IndexCounter{},
+	}
+
+	if c.SecondaryContainerURL != nil {
+		u.containers = append(u.containers, *c.SecondaryContainerURL)
+	}
+
+	// Fail early if the Store_As settings are unusable.
+	w, err := NewBatchWriter(c)
+	if err != nil {
+		return nil, err
+	}
+	w.Close()
+
+	if c.BufferPath != "" {
+		buffer, err := NewFileBuffer(c.BufferPath)
+		if err != nil {
+			return nil, err
+		}
+		u.buffer = buffer
+		u.resumeStaged()
+		u.replay()
+
+		interval := c.BufferRetry
+		if interval <= 0 {
+			interval = DefaultBufferRetry
+		}
+		u.retryTicker = time.NewTicker(interval)
+	}
+
+	if c.SecretFile != "" {
+		u.secrets = NewSecretWatcher(
+			c.SecretFile, c.SecretRefresh, c.Secret, u.rotateSecret)
+	}
+
+	if c.TokenSource != nil {
+		u.tokens = NewTokenRefresher(c.TokenCredential, c.TokenSource, l)
 	}
 
 	u.wg.Add(1)
@@ -68,10 +146,103 @@ func NewUploader(c *AzblobConfig, l *logrus.Entry) (*AzblobUploader, error) {
 	return u, nil
 }
 
+// containerURL returns the container URL with the current credential.
+func (u *AzblobUploader) containerURL() azblob.ContainerURL {
+	u.containerMu.RLock()
+	defer u.containerMu.RUnlock()
+
+	return u.containers[u.active]
+}
+
+// withFailover runs f, and runs it once more with the other access key if
+// the service rejected the current one.
+func (u *AzblobUploader) withFailover(f func() error) error {
+	u.containerMu.RLock()
+	active := u.active
+	u.containerMu.RUnlock()
+
+	err := f()
+	if err == nil || len(u.containers) < 2 || !isAuthFailure(err) {
+		return err
+	}
+
+	u.containerMu.Lock()
+	// Another upload may have switched keys in the meantime.
+	if u.active == active {
+		u.active = (active + 1) % len(u.containers)
+		u.logger.Warnf("authentication failed, switching to the %s access key",
+			[]string{"primary", "secondary"}[u.active])
+	}
+	u.containerMu.Unlock()
+
+	return f()
+}
+
+func isAuthFailure(err error) bool {
+	serr, ok := err.(azblob.StorageError)
+	if !ok {
+		return false
+	}
+
+	return serr.ServiceCode() == azblob.ServiceCodeAuthenticationFailed ||
+		(serr.Response() != nil &&
+			serr.Response().StatusCode == http.StatusForbidden)
+}
+
+// rotateSecret swaps the credential once the secret file has changed.
+// Uploads already in flight finish with the previous credential.
+func (u *AzblobUploader) rotateSecret(secret string) error {
+	container, err := u.config.ContainerURLFromSecret(secret)
+	if err != nil {
+		return err
+	}
+
+	// The rotated file holds the primary key, switch back to it.
+	u.containerMu.Lock()
+	u.containers[0] = container
+	u.active = 0
+	u.sasWarnedAt = time.Time{}
+	u.containerMu.Unlock()
+
+	u.logger.Infof("credential rotated, file=%s", u.config.SecretFile)
+	return nil
+}
+
+// checkSASExpiry warns when the SAS in use is about to expire.
+func (u *AzblobUploader) checkSASExpiry() {
+	u.containerMu.Lock()
+	defer u.containerMu.Unlock()
+
+	URL := u.containers[u.active].URL()
+	expiry, ok := sasExpiry(URL.RawQuery)
+	if !ok || time.Until(expiry) > SASExpiryWarning ||
+		time.Since(u.sasWarnedAt) < SASWarningInterval {
+		return
+	}
+
+	u.sasWarnedAt = time.Now()
+	if time.Now().After(expiry) {
+		u.logger.Errorf("SAS expired at %v", expiry)
+	} else {
+		u.logger.Warnf("SAS expires at %v", expiry)
+	}
+}
+
 func (u *AzblobUploader) start() {
+	// Without a buffer there is nothing to resend.
+	var retryTick <-chan time.Time
+	if u.retryTicker != nil {
+		retryTick = u.retryTicker.C
+	}
+
 	defer func() {
-		for ts, b := range u.batches {
-			u.sendBatch(ts, b.Buffer)
+		for _, b := range u.batches {
+			u.sendBatch(b)
+		}
+
+		u.sending.Wait()
+		if u.config.BlobType == StagedBlobType {
+			u.commitTargets(true)
 		}
 
 		u.wg.Done()
@@ -82,75 +253,382 @@ func (u *AzblobUploader) start() {
 		case <-u.quit:
 			return
 		case <-u.timeTicker.C:
+			u.checkSASExpiry()
+
 			for ts, b := range u.batches {
 				if time.Since(b.CreatedAt) < u.config.BatchWait {
 					continue
 				}
 
 				u.logger.Debug("max wait time reached, sending batch...")
-				go u.sendBatch(ts, b.Buffer)
+				u.goSendBatch(b)
+				delete(u.batches, ts)
+			}
+
+			if u.config.BlobType == StagedBlobType &&
+				atomic.CompareAndSwapInt32(&u.committing, 0, 1) {
+				go func() {
+					u.commitTargets(false)
+					atomic.StoreInt32(&u.committing, 0)
+				}()
+			}
+		case <-retryTick:
+			u.replay()
+		case ack := <-u.flush:
+			for ts, b := range u.batches {
+				if ack != nil && !b.hasAck(ack) {
+					continue
+				}
+
+				u.logger.Debug("flush requested, sending batch...")
+				u.goSendBatch(b)
 				delete(u.batches, ts)
 			}
 		case e := <-u.Entries:
-			batch, ok := u.batches[e.TimeSlice]
+			id := strings.Join([]string{e.Tag, e.Key, e.TimeSlice}, "\x00")
+			batch, ok := u.batches[id]
 
 			if !ok {
-				u.batches[e.TimeSlice] = &Batch{
-					Buffer:    e.Raw,
-					CreatedAt: time.Now(),
+				if b := u.newBatch(e); b != nil {
+					u.batches[id] = b
 				}
 				break
 			}
 
-			if uint64(len(batch.Buffer)) > u.config.BatchLimitSize {
+			if uint64(batch.Writer.Size()) > u.config.BatchLimitSize {
 				u.logger.Debug("max size reached, sending batch...")
-				go u.sendBatch(e.TimeSlice, batch.Buffer)
+				u.goSendBatch(batch)
+				delete(u.batches, id)
 
-				u.batches[e.TimeSlice] = &Batch{
-					Buffer:    e.Raw,
-					CreatedAt: time.Now(),
+				if b := u.newBatch(e); b != nil {
+					u.batches[id] = b
 				}
 				break
 			}
 
-			batch.Buffer = append(batch.Buffer, "\n"...)
-			batch.Buffer = append(batch.Buffer, e.Raw...)
+			u.addEntry(batch, e)
+		}
+	}
+}
+
+func (b *Batch) hasAck(ack *Ack) bool {
+	for _, a := range b.Acks {
+		if a == ack {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newBatch starts a batch with an entry, or returns nil if the entry cannot
+// be encoded.
+func (u *AzblobUploader) newBatch(e Entry) *Batch {
+	// The settings have been checked by NewUploader.
+	w, _ := NewBatchWriter(u.config)
+	if err := w.Write(e.Raw); err != nil {
+		u.dropEntry(e, err)
+		return nil
+	}
+
+	b := &Batch{
+		Tag:       e.Tag,
+		Key:       e.Key,
+		Time:      e.Time,
+		TimeSlice: e.TimeSlice,
+		Writer:    w,
+		CreatedAt: time.Now(),
+	}
+	if e.Ack != nil {
+		b.Acks = append(b.Acks, e.Ack)
+	}
+
+	if u.buffer != nil {
+		s, err := u.buffer.Create(SegmentHeader{
+			Tag:       b.Tag,
+			Key:       b.Key,
+			TimeSlice: b.TimeSlice,
+			Time:      b.Time,
+			CreatedAt: b.CreatedAt,
+		})
+		if err != nil {
+			u.logger.Errorf("create buffer segment error: %v", err)
+			return b
+		}
+
+		if err := s.Append(e.Raw); err != nil {
+			u.logger.Errorf("write buffer segment error: %v", err)
+		}
+		b.Segment = s
+		u.claimSegment(s.Path())
+	}
+
+	return b
+}
+
+func (u *AzblobUploader) addEntry(b *Batch, e Entry) {
+	if err := b.Writer.Write(e.Raw); err != nil {
+		u.dropEntry(e, err)
+		return
+	}
+	if e.Ack != nil {
+		b.Acks = append(b.Acks, e.Ack)
+	}
+
+	if b.Segment != nil {
+		if err := b.Segment.Append(e.Raw); err != nil {
+			u.logger.Errorf("write buffer segment error: %v", err)
+		}
+	}
+}
+
+// dropEntry gives up an entry which cannot be encoded. Its chunk is retried
+// in sync mode.
+func (u *AzblobUploader) dropEntry(e Entry, err error) {
+	u.logger.Errorf("write batch error, tag=%s: %v", e.Tag, err)
+	if e.Ack != nil {
+		e.Ack.Done(err)
+	}
+}
+
+// replay re-sends the batches left in the buffer directory by a previous run,
+// or kept there after a failed upload. Segments of batches which are still
+// open or being sent are skipped.
+func (u *AzblobUploader) replay() {
+	paths, err := u.buffer.Segments()
+	if err != nil {
+		u.logger.Errorf("list buffer segments error: %v", err)
+		return
+	}
+
+	for _, path := range paths {
+		if !u.claimSegment(path) {
+			continue
+		}
+
+		s, entries, err := ReadSegment(path)
+		if err != nil {
+			u.logger.Errorf("read buffer segment error: %v", err)
+			u.releaseSegment(path)
+			continue
 		}
+
+		if len(entries) == 0 {
+			s.Remove()
+			u.releaseSegment(path)
+			continue
+		}
+
+		w, _ := NewBatchWriter(u.config)
+		for _, raw := range entries {
+			if err := w.Write(raw); err != nil {
+				u.logger.Errorf("write batch error: %v", err)
+			}
+		}
+
+		u.logger.Infof(
+			"replay buffered batch, segment=%s entries=%d", path, len(entries))
+		u.goSendBatch(&Batch{
+			Tag:       s.Header.Tag,
+			Key:       s.Header.Key,
+			Time:      s.Header.Time,
+			TimeSlice: s.Header.TimeSlice,
+			Writer:    w,
+			CreatedAt: s.Header.CreatedAt,
+			Segment:   s,
+		})
+	}
+}
+
+// claimSegment marks a segment as owned by a batch. It returns false if the
+// segment is owned already.
+func (u *AzblobUploader) claimSegment(path string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.segments[path] {
+		return false
+	}
+	u.segments[path] = true
+
+	return true
+}
+
+func (u *AzblobUploader) releaseSegment(path string) {
+	u.mu.Lock()
+	delete(u.segments, path)
+	u.mu.Unlock()
+}
+
+// Flush sends the open batches holding entries of ack without waiting for
+// Batch_Wait, or all open batches if ack is nil.
+func (u *AzblobUploader) Flush(ack *Ack) {
+	select {
+	case u.flush <- ack:
+	case <-u.quit:
 	}
 }
 
 func (u *AzblobUploader) Stop() {
 	u.once.Do(func() { close(u.quit) })
 	u.wg.Wait()
+
+	if u.secrets != nil {
+		u.secrets.Stop()
+	}
+	if u.tokens != nil {
+		u.tokens.Stop()
+	}
 }
 
-func (u *AzblobUploader) sendBatch(timeSlice string, b []byte) {
+// batchTime returns the time of the first record of a batch in the
+// configured time zone.
+func (u *AzblobUploader) batchTime(b *Batch) time.Time {
+	t := b.Time
+	// Segments journaled by older versions have no time.
+	if t.IsZero() {
+		t = b.CreatedAt
+	}
+	if u.config.Location != nil {
+		t = t.In(u.config.Location)
+	}
+
+	return t
+}
+
+func (u *AzblobUploader) goSendBatch(batch *Batch) {
+	u.sending.Add(1)
+	go func() {
+		defer u.sending.Done()
+		u.sendBatch(batch)
+	}()
+}
+
+func (u *AzblobUploader) sendBatch(batch *Batch) {
+	if batch.Segment != nil {
+		if err := batch.Segment.Seal(); err != nil {
+			u.logger.Warnf("seal buffer segment error: %v", err)
+		}
+	}
+
 	// Generate ObjectKey
-	objectKey := u.config.ObjectKeyFormat
-	objectKey = strings.ReplaceAll(objectKey, "%{hostname}", Hostname)
-	objectKey = strings.ReplaceAll(objectKey, "%{uuid}", uuid.NewV4().String())
-	objectKey = strings.ReplaceAll(objectKey, "%{time_slice}", timeSlice)
+	objectKey := batch.Key
+	// Segments journaled by older versions have no key.
+	if objectKey == "" {
+		objectKey = u.config.ObjectKeyFormat
+	}
+	objectKey = strings.ReplaceAll(objectKey, "%{time_slice}", batch.TimeSlice)
+	objectKey = renderTime(objectKey, u.batchTime(batch))
 
-	u.logger.Debugf("upload blob=%s size: %d bytes", objectKey, len(b))
+	// Closing the writer compresses the batch once, retries upload the same
+	// bytes.
+	buf, err := batch.Writer.Close()
+	if err != nil {
+		u.logger.Errorf("compress batch error: %v", err)
+		u.finishBatch(batch, err)
+		return
+	}
 
-	var buf []byte
-	var err error
-	err = retry(u.config.BatchRetryLimit, func() error {
-		switch u.config.StoreAs {
-		case GzipFormat:
-			buf, err = makeGzip(b)
-			if err != nil {
-				u.logger.Error(err.Error())
-				return err
-			}
+	if u.config.BlobType == BlockBlobType {
+		objectKey = renderDigest(objectKey, buf)
+		if !strings.Contains(objectKey, "%{index}") {
+			objectKey = renderUnique(objectKey)
 		}
+	}
+
+	u.logger.Debugf("upload blob=%s size: %d bytes", objectKey, len(buf))
+
+	// A sync chunk is acknowledged once its blocks are committed.
+	commit := u.config.DeliveryMode == SyncDelivery && len(batch.Acks) > 0
+
+	// The append target is held until the batch is appended or given up.
+	var target *AppendTarget
+	if u.config.BlobType == AppendBlobType {
+		target = u.appendTarget(objectKey)
+		target.mu.Lock()
+	}
 
-		return u.upload(objectKey, buf)
+	var appended int
+	index := -1
+	err = retry(u.config.BatchRetryLimit, func() error {
+		return u.withFailover(func() error {
+			switch u.config.BlobType {
+			case AppendBlobType:
+				return u.appendBlob(target, objectKey, buf, &appended)
+			case StagedBlobType:
+				return u.stageBlock(
+					objectKey, batch.TimeSlice, buf, &appended, commit)
+			}
+			if strings.Contains(objectKey, "%{index}") {
+				return u.uploadIndexed(objectKey, buf, &index)
+			}
+			return u.upload(objectKey, buf)
+		})
 	})
 
+	if target != nil {
+		target.mu.Unlock()
+	}
+
 	if err != nil {
 		u.logger.Errorf("retry limit reached, blob=%s", objectKey)
 	}
+	u.finishBatch(batch, err)
+}
+
+// finishBatch acknowledges the entries of a batch, and removes the batch from
+// the buffer unless it has to be sent again.
+func (u *AzblobUploader) finishBatch(batch *Batch, err error) {
+	for _, ack := range batch.Acks {
+		ack.Done(err)
+	}
+
+	if err != nil {
+		// Fluent Bit retries acknowledged chunks itself, keeping them in the
+		// buffer as well would upload the entries twice.
+		// It is sent again at the next Buffer_Retry_Interval.
+		if batch.Segment != nil && len(batch.Acks) == 0 {
+			u.logger.Warnf(
+				"batch kept in buffer, segment=%s", batch.Segment.Path())
+			u.releaseSegment(batch.Segment.Path())
+			return
+		}
+	}
+
+	if batch.Segment != nil {
+		if err := batch.Segment.Remove(); err != nil {
+			u.logger.Warnf("remove buffer segment error: %v", err)
+		}
+		u.releaseSegment(batch.Segment.Path())
+	}
+}
+
+func NewAck() *Ack {
+	return &Ack{}
+}
+
+// Add registers an entry that has to be uploaded before Wait returns.
+func (a *Ack) Add() {
+	a.wg.Add(1)
+}
+
+// Done marks an entry as uploaded, or as failed if err is not nil.
+func (a *Ack) Done(err error) {
+	if err != nil {
+		a.mu.Lock()
+		a.err = err
+		a.mu.Unlock()
+	}
+	a.wg.Done()
+}
+
+// Wait blocks until all entries are done and returns the last upload error.
+func (a *Ack) Wait() error {
+	a.wg.Wait()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
 }
 
 func retry(attempts *uint64, f Func) error {
@@ -178,27 +656,12 @@ func retry(attempts *uint64, f Func) error {
 	}
 }
 
-// based on https://text.baldanders.info/golang/gzip-operation/
-func makeGzip(buf []byte) ([]byte, error) {
-	var b bytes.Buffer
-
-	err := func() error {
-		gw := gzip.NewWriter(&b)
-		gw.Name = "fluent-bit-go-azblob"
-		gw.ModTime = time.Now()
-
-		defer gw.Close()
-
-		if _, err := gw.Write(buf); err != nil {
-			return err
-		}
-		return nil
-	}()
-
-	return b.Bytes(), err
+func (u *AzblobUploader) upload(objectKey string, b []byte) error {
+	return u.uploadBlob(objectKey, b, azblob.BlobAccessConditions{})
 }
 
-func (u *AzblobUploader) upload(objectKey string, b []byte) error {
+func (u *AzblobUploader) uploadBlob(objectKey string, b []byte,
+	conditions azblob.BlobAccessConditions) error {
 	ctx, cancel := context.WithTimeout(
 		context.Background(), Timeout*time.Second)
 	defer cancel()
@@ -210,10 +673,14 @@ func (u *AzblobUploader) upload(objectKey string, b []byte) error {
 		}
 	}
 
-	blobURL := u.container.NewBlockBlobURL(objectKey)
+	blobURL := u.containerURL().NewBlockBlobURL(objectKey)
 	options := azblob.UploadToBlockBlobOptions{
 		BlockSize:   BlockSize,
 		Parallelism: Parallelism,
+		BlobHTTPHeaders: azblob.BlobHTTPHeaders{
+			ContentEncoding: u.config.StoreAs.ContentEncoding(),
+		},
+		AccessConditions: conditions,
 	}
 	_, err := azblob.UploadBufferToBlockBlob(ctx, b, blobURL, options)
 	if err != nil {
@@ -227,12 +694,14 @@ func (u *AzblobUploader) upload(objectKey string, b []byte) error {
 func (u *AzblobUploader) ensureContainer(ctx context.Context) error {
 	var err error
 
-	_, err = u.container.GetProperties(ctx, azblob.LeaseAccessConditions{})
+	container := u.containerURL()
+
+	_, err = container.GetProperties(ctx, azblob.LeaseAccessConditions{})
 	if err == nil {
 		return nil
 	}
 
-	_, err = u.container.Create(ctx, azblob.Metadata{}, PublicAccessType)
+	_, err = container.Create(ctx, azblob.Metadata{}, PublicAccessType)
 	if err != nil {
 		return err
 	}
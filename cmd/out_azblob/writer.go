@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ZstdWindowSize bounds the memory of a zstd encoder.
+const ZstdWindowSize = 1 << 20 // 1m
+
+// BatchWriter encodes the entries of a batch into the payload of a blob as
+// they arrive, so that a batch is compressed exactly once.
+type BatchWriter interface {
+	// Write adds an entry to the batch.
+	Write(raw []byte) error
+	// Size returns the size of the payload written so far, which
+	// Batch_Limit_Size applies to.
+	Size() int
+	// Close finishes the batch and returns its payload.
+	Close() ([]byte, error)
+}
+
+// Compressors take hundreds of kilobytes up to megabytes each, so they are
+// reused by the following batches once a batch is closed.
+var (
+	gzipPools = map[int]*sync.Pool{}
+	zstdPools = map[zstd.EncoderLevel]*sync.Pool{}
+	poolsMu   sync.Mutex
+)
+
+func gzipPool(level int) *sync.Pool {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+
+	p, ok := gzipPools[level]
+	if !ok {
+		p = &sync.Pool{New: func() interface{} {
+			// The level has been checked by NewBatchWriter.
+			gw, _ := gzip.NewWriterLevel(nil, level)
+			return gw
+		}}
+		gzipPools[level] = p
+	}
+
+	return p
+}
+
+func zstdPool(level zstd.EncoderLevel) *sync.Pool {
+	poolsMu.Lock()
+	defer poolsMu.Unlock()
+
+	p, ok := zstdPools[level]
+	if !ok {
+		p = &sync.Pool{New: func() interface{} {
+			// A small window bounds the memory held by every open batch,
+			// and the input a batch holds back before it is compressed.
+			zw, _ := zstd.NewWriter(nil,
+				zstd.WithEncoderLevel(level),
+				zstd.WithEncoderConcurrency(1),
+				zstd.WithWindowSize(ZstdWindowSize),
+				zstd.WithZeroFrames(true))
+			return zw
+		}}
+		zstdPools[level] = p
+	}
+
+	return p
+}
+
+// lineWriter writes entries as lines, optionally through a compressor.
+// Entries without a delimiter, like msgpack events, are concatenated.
+type lineWriter struct {
+	buf        bytes.Buffer
+	w          io.Writer
+	compressor io.WriteCloser
+	release    func()
+	delimiter  []byte
+	lines      int
+	terminate  bool
+}
+
+// NewBatchWriter creates the writer of a batch in the Store_As format. Blobs
+// holding many batches need the last line of a batch to be terminated, so
+// that the next batch starts on a new line.
+func NewBatchWriter(c *AzblobConfig) (BatchWriter, error) {
+	switch c.StoreAs {
+	case ParquetFormat:
+		return newParquetWriter(c), nil
+	case AvroFormat:
+		return newAvroWriter(c)
+	}
+
+	lw := &lineWriter{terminate: c.BlobType != BlockBlobType}
+	lw.w = &lw.buf
+	if c.StoreAs != MsgpackFormat {
+		lw.delimiter = []byte("\n")
+	}
+
+	switch c.StoreAs {
+	case GzipFormat:
+		if c.CompressionLevel < gzip.HuffmanOnly ||
+			c.CompressionLevel > gzip.BestCompression {
+			return nil, fmt.Errorf(
+				"invalid gzip compression level: %d", c.CompressionLevel)
+		}
+
+		// Every batch is a gzip member of its own. Concatenated members in
+		// a blob still form a valid gzip stream.
+		p := gzipPool(c.CompressionLevel)
+		gw := p.Get().(*gzip.Writer)
+		gw.Reset(&lw.buf)
+		gw.Name = "fluent-bit-go-azblob"
+		gw.ModTime = time.Now()
+		lw.compressor, lw.release = gw, func() { p.Put(gw) }
+	case ZstdFormat:
+		// Concatenated zstd frames are a valid stream as well.
+		p := zstdPool(zstd.EncoderLevelFromZstd(c.CompressionLevel))
+		zw := p.Get().(*zstd.Encoder)
+		zw.Reset(&lw.buf)
+		lw.compressor, lw.release = zw, func() { p.Put(zw) }
+	}
+	if lw.compressor != nil {
+		lw.w = lw.compressor
+	}
+
+	if c.HeaderRow {
+		header, err := createHeader(c)
+		if err != nil {
+			return nil, err
+		}
+		if err := lw.Write(header); err != nil {
+			return nil, err
+		}
+	}
+
+	return lw, nil
+}
+
+func (lw *lineWriter) Write(raw []byte) error {
+	if lw.lines > 0 && lw.delimiter != nil {
+		if _, err := lw.w.Write(lw.delimiter); err != nil {
+			return err
+		}
+	}
+	lw.lines++
+
+	_, err := lw.w.Write(raw)
+	return err
+}
+
+// Size is the compressed size of the entries written so far, without the
+// last entries which are still held by the compressor.
+func (lw *lineWriter) Size() int {
+	return lw.buf.Len()
+}
+
+func (lw *lineWriter) Close() ([]byte, error) {
+	if lw.terminate && lw.delimiter != nil {
+		if _, err := lw.w.Write(lw.delimiter); err != nil {
+			return nil, err
+		}
+	}
+	if lw.compressor != nil {
+		err := lw.compressor.Close()
+		lw.release()
+		lw.compressor, lw.w = nil, &lw.buf
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return lw.buf.Bytes(), nil
+}
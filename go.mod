@@ -8,9 +8,15 @@ require (
 	github.com/fluent/fluent-bit-go v0.0.0-20200729034236-b9c0d6a20853
 	github.com/joho/godotenv v1.3.0
 	github.com/json-iterator/go v1.1.10
+	github.com/klauspost/compress v1.11.4
+	github.com/linkedin/goavro/v2 v2.10.0
+	github.com/oklog/ulid v1.3.1
 	github.com/onsi/ginkgo v1.14.0 // indirect
 	github.com/satori/go.uuid v1.2.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.6.1
+	github.com/ugorji/go/codec v1.1.7
+	github.com/xitongsys/parquet-go v1.6.0
+	github.com/xitongsys/parquet-go-source v0.0.0-20200817004010-026bad9b25d0
 	golang.org/x/crypto v0.0.0-20200820211705-5c72a883971a
 )